@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// cachePersister is implemented by collectors whose cache can be saved to disk and restored at startup.
+type cachePersister interface {
+	// PersistCache restores the cache from the file if still valid, and saves it to the file after each collection.
+	PersistCache(target string, file string)
+}
+
+// collectorCacheFile is the content of the cache file of a collector: metric families collected at Time, by the
+// queries and metrics identified by Hash.
+type collectorCacheFile struct {
+	Target    string            `json:"target"`
+	Collector string            `json:"collector"`
+	Hash      string            `json:"definition_hash"`
+	Time      time.Time         `json:"time"`
+	Families  []json.RawMessage `json:"families"`
+}
+
+// cacheFileName returns the path of the cache file of a collector of a target in the cache directory: the name is the
+// hash of the target and collector names, that can hold any character (e.g. data source name of a dynamic target)
+// and must not give the same file for two pairs. The file holds both names.
+func cacheFileName(dir string, target string, collector string) string {
+	h := sha256.Sum256([]byte(target + "\x00" + collector))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".json")
+}
+
+// definitionHash returns the hash of the text of the queries of the collector and of the definitions of their metrics
+// (name, type, labels, values...): the cache of a collector whose queries or metrics have changed is invalid.
+func (c *collector) definitionHash() string {
+	h := sha256.New()
+	for _, q := range c.queries {
+		fmt.Fprintf(h, "%s\x00", q.config.Query)
+		if q.config.ForEach != nil {
+			fmt.Fprintf(h, "%s\x00", q.config.ForEach.Query)
+		}
+		for _, mf := range q.metricFamilies {
+			// maps are encoded with sorted keys
+			if buf, err := json.Marshal(mf.config); err == nil {
+				h.Write(buf)
+			}
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PersistCache implements cachePersister.
+func (cc *cachingCollector) PersistCache(target string, file string) {
+	cc.cacheTarget = target
+	cc.cacheFile = file
+
+	var logCtx []interface{}
+	logCtx = append(logCtx, cc.rawColl.logContext...)
+	metrics, cacheTime, err := cc.loadCache()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logCtx = append(logCtx, "msg", fmt.Sprintf("cache file %s ignored: %s", file, err))
+			cc.rawColl.logger.Warn("stacked", logCtx...)
+			os.Remove(file)
+		}
+		return
+	}
+	<-cc.cacheSem
+	cc.cache = metrics
+	// only successful collections are saved
+	cc.rawColl.lastError.record(CollectorStatusOk, nil)
+	cc.cacheSem <- cacheTime
+	logCtx = append(logCtx, "msg", fmt.Sprintf("restored %d cached metrics from %s: cache_age=%.3fs",
+		len(metrics), file, time.Since(cacheTime).Seconds()))
+	cc.rawColl.logger.Debug("stacked", logCtx...)
+}
+
+// loadCache reads the metrics of the cache file, if collected by the same collector, queries and metrics.
+func (cc *cachingCollector) loadCache() ([]Metric, time.Time, error) {
+	buf, err := os.ReadFile(cc.cacheFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var content collectorCacheFile
+	if err := json.Unmarshal(buf, &content); err != nil {
+		return nil, time.Time{}, err
+	}
+	if content.Target != cc.cacheTarget || content.Collector != cc.rawColl.config.Name {
+		return nil, time.Time{}, fmt.Errorf("saved for target %q collector %q", content.Target, content.Collector)
+	}
+	if content.Hash != cc.rawColl.definitionHash() {
+		return nil, time.Time{}, fmt.Errorf("queries or metrics of collector have changed")
+	}
+
+	metrics := make([]Metric, 0, len(content.Families))
+	for _, raw := range content.Families {
+		dtoMetricFamily := &dto.MetricFamily{}
+		if err := protojson.Unmarshal(raw, dtoMetricFamily); err != nil {
+			return nil, time.Time{}, err
+		}
+		valueType := prometheus.UntypedValue
+		switch dtoMetricFamily.GetType() {
+		case dto.MetricType_GAUGE:
+			valueType = prometheus.GaugeValue
+		case dto.MetricType_COUNTER:
+			valueType = prometheus.CounterValue
+		}
+		desc := NewAutomaticMetricDesc(cc.rawColl.logContext,
+			dtoMetricFamily.GetName(), dtoMetricFamily.GetHelp(), valueType, nil)
+		for _, dtoMetric := range dtoMetricFamily.Metric {
+			metrics = append(metrics, &restoredMetric{desc: desc, metric: dtoMetric})
+		}
+	}
+	return metrics, content.Time, nil
+}
+
+// saveCache writes the cached metrics collected at cacheTime to the cache file, if set; invalid metrics are not saved.
+func (cc *cachingCollector) saveCache(cacheTime time.Time) {
+	if cc.cacheFile == "" {
+		return
+	}
+	var logCtx []interface{}
+	logCtx = append(logCtx, cc.rawColl.logContext...)
+
+	content := collectorCacheFile{
+		Target:    cc.cacheTarget,
+		Collector: cc.rawColl.config.Name,
+		Hash:      cc.rawColl.definitionHash(),
+		Time:      cacheTime,
+	}
+	families := make(map[string]*dto.MetricFamily)
+	names := make([]string, 0)
+	for _, metric := range cc.cache {
+		dtoMetric := &dto.Metric{}
+		if err := metric.Write(dtoMetric); err != nil {
+			continue
+		}
+		name := metric.Desc().Name()
+		dtoMetricFamily, found := families[name]
+		if !found {
+			dtoMetricFamily = &dto.MetricFamily{
+				Name: proto.String(name),
+				Help: proto.String(metric.Desc().Help()),
+			}
+			switch {
+			case dtoMetric.Gauge != nil:
+				dtoMetricFamily.Type = dto.MetricType_GAUGE.Enum()
+			case dtoMetric.Counter != nil:
+				dtoMetricFamily.Type = dto.MetricType_COUNTER.Enum()
+			case dtoMetric.Histogram != nil:
+				dtoMetricFamily.Type = dto.MetricType_HISTOGRAM.Enum()
+			case dtoMetric.Summary != nil:
+				dtoMetricFamily.Type = dto.MetricType_SUMMARY.Enum()
+			}
+			families[name] = dtoMetricFamily
+			names = append(names, name)
+		}
+		dtoMetricFamily.Metric = append(dtoMetricFamily.Metric, dtoMetric)
+	}
+	for _, name := range names {
+		raw, err := protojson.Marshal(families[name])
+		if err != nil {
+			logCtx = append(logCtx, "msg", fmt.Sprintf("cache not saved: %s", err))
+			cc.rawColl.logger.Warn("stacked", logCtx...)
+			return
+		}
+		content.Families = append(content.Families, raw)
+	}
+
+	if err := writeCacheFile(cc.cacheFile, &content); err != nil {
+		logCtx = append(logCtx, "msg", fmt.Sprintf("cache not saved: %s", err))
+		cc.rawColl.logger.Warn("stacked", logCtx...)
+	}
+}
+
+// writeCacheFile writes the content to a temporary file renamed to the cache file, so that a crash never leaves a
+// truncated cache file.
+func writeCacheFile(file string, content *collectorCacheFile) error {
+	buf, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// restoredMetric is a metric restored from a cache file.
+type restoredMetric struct {
+	desc   MetricDesc
+	metric *dto.Metric
+}
+
+// Desc implements Metric.
+func (m *restoredMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *restoredMetric) Write(out *dto.Metric) error {
+	proto.Merge(out, m.metric)
+	return nil
+}
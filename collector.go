@@ -4,9 +4,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
@@ -17,6 +20,7 @@ const (
 	CollectorStatusOk
 	CollectorStatusInvalidLogin
 	CollectorStatusTimeout
+	CollectorStatusPartial
 )
 
 // Collector is a self-contained group of SQL queries and metric families to collect from a specific database. It is
@@ -33,50 +37,63 @@ type Collector interface {
 type collector struct {
 	config     *CollectorConfig
 	queries    []*Query
+	variables  VariablesConfig
 	logContext []interface{}
 	logger     *slog.Logger
-	status     int
+	// status, last error and consecutive failures, also for the target status page
+	lastError errorState
+
+	// per_database mode: connections to each database, opened from the target connection baseConn
+	dbConnsMutex sync.Mutex
+	dbConns      map[string]*databasePool
+	baseConn     *sql.DB
 }
 
 // NewCollector returns a new Collector with the given configuration and database. The metrics it creates will all have
-// the provided const labels applied.
+// the provided const labels applied; variables of the target are added to the symbols table passed to the queries.
 func NewCollector(
 	logContext []interface{},
 	logger *slog.Logger,
 	cc *CollectorConfig,
-	constLabels []*dto.LabelPair) (Collector, error) {
+	constLabels []*dto.LabelPair,
+	variables VariablesConfig) (Collector, error) {
 
 	logContext = append(logContext, "collector", cc.Name)
 
 	// Maps each query to the list of metric families it populates.
 	queryMFs := make(map[*QueryConfig][]*MetricFamily, len(cc.Metrics))
+	// Queries in order of first use by metrics: the order they are granted a slot on a target with a query limit.
+	queryConfigs := make([]*QueryConfig, 0, len(cc.Metrics))
 
 	// Instantiate metric families.
 	for _, mc := range cc.Metrics {
-		mf, err := NewMetricFamily(logContext, mc, constLabels)
+		mf, err := NewMetricFamily(logContext, mc, constLabels, variables)
 		if err != nil {
 			return nil, err
 		}
 		mfs, found := queryMFs[mc.Query()]
 		if !found {
 			mfs = make([]*MetricFamily, 0, 2)
+			queryConfigs = append(queryConfigs, mc.Query())
 		}
 		queryMFs[mc.Query()] = append(mfs, mf)
 	}
 
 	// Instantiate queries.
 	queries := make([]*Query, 0, len(cc.Metrics))
-	for qc, mfs := range queryMFs {
-		q, err := NewQuery(logContext, logger, qc, mfs...)
+	for _, qc := range queryConfigs {
+		q, err := NewQuery(logContext, logger, qc, queryMFs[qc]...)
 		if err != nil {
 			return nil, err
 		}
+		q.order = len(queries)
 		queries = append(queries, q)
 	}
 
 	c := collector{
 		config:     cc,
 		queries:    queries,
+		variables:  variables,
 		logContext: logContext,
 		logger:     logger,
 	}
@@ -100,13 +117,13 @@ func (c *collector) Name() string {
 // GetStatus implement GetStatus for collector
 // obtain the status of collector scripts execution
 func (c *collector) Status() int {
-	return c.status
+	return c.lastError.Status()
 }
 
 // SetStatus implement SetStatus for collector
 // set the status error of collector scripts execution
 func (c *collector) SetStatus(status int) {
-	c.status = status
+	c.lastError.SetStatus(status)
 }
 
 // Collect implements Collector.
@@ -115,36 +132,130 @@ func (c *collector) Collect(
 	conn *sql.DB,
 	symbols_table map[string]interface{},
 	ch chan<- Metric) {
+	status, err := c.collect(ctx, conn, symbols_table, ch)
+	// set collector execution status
+	c.lastError.record(status, err)
+}
+
+// collect runs the queries of the collector and returns the status of the run, with the errors reported by the
+// queries (or the databases).
+func (c *collector) collect(
+	ctx context.Context,
+	conn *sql.DB,
+	symbols_table map[string]interface{},
+	ch chan<- Metric) (int, error) {
+	if len(c.variables) > 0 {
+		// don't modify target symbols table: variables may differ by collector
+		symbols := make(map[string]interface{}, len(symbols_table)+len(c.variables))
+		for name, value := range c.variables {
+			symbols[name] = value
+		}
+		maps.Copy(symbols, symbols_table)
+		symbols_table = symbols
+	}
+	// keep the errors reported by the queries (or the databases) for the target status page.
+	errCh, errs := collectErrors(ch)
+	var status int
+	if c.config.PerDatabase != nil {
+		status = c.collectPerDatabase(ctx, conn, symbols_table, errCh)
+	} else {
+		status = c.collectQueries(ctx, conn, symbols_table, nil, errCh)
+	}
+	close(errCh)
+	c.logger.Debug(fmt.Sprintf("check collector status for %s: %d", c.Name(), status))
+	return status, <-errs
+}
+
+// collectQueries runs all the queries of the collector in parallel on the connection (sequentially on a pinned
+// connection, that can't run concurrent queries), with the labels values added to the rows, and returns the status of
+// their execution.
+func (c *collector) collectQueries(
+	ctx context.Context,
+	conn sqlQueryer,
+	symbols_table map[string]interface{},
+	labels map[string]string,
+	ch chan<- Metric) int {
 	var (
 		wg sync.WaitGroup
 	)
-	wg.Add(len(c.queries))
-	c.status = CollectorStatusError
+	// status of each query execution
+	statuses := make([]int, len(c.queries))
+	if _, pinned := conn.(*sql.Conn); pinned {
+		for i, q := range c.queries {
+			statuses[i], _ = q.Collect(ctx, conn, symbols_table, labels, ch)
+		}
+	} else {
+		wg.Add(len(c.queries))
+		for i, q := range c.queries {
+			go func(i int, q *Query) {
+				defer wg.Done()
+				statuses[i], _ = q.Collect(ctx, conn, symbols_table, labels, ch)
+			}(i, q)
+		}
+		// Only return once all queries have been processed
+		wg.Wait()
+	}
+	return mergeStatus(statuses...)
+}
+
+// mergeStatus returns the status of a collection made of several executions (queries, databases): ok if all of them
+// succeeded, partial if only some of them failed, else the status of the failures, invalid login first, then timeout.
+func mergeStatus(statuses ...int) int {
+	failed := 0
 	status := CollectorStatusOk
-	for _, q := range c.queries {
-		go func(q *Query) {
-			defer wg.Done()
-			q.Collect(ctx, conn, symbols_table, ch)
-		}(q)
-	}
-	// Only return once all queries have been processed
-	wg.Wait()
-	c.logger.Debug(fmt.Sprintf("check collector status for %s", c.Name()))
-	// logContext always contains at least 2 pairs of values: (target, target_name) (collector, collector_name)
-	// so if length if greater than 4 there were errors !
-	if len(c.logContext) > 4 {
-		status = CollectorStatusError
+	for _, s := range statuses {
+		switch s {
+		case CollectorStatusOk:
+			continue
+		case CollectorStatusPartial:
+			return CollectorStatusPartial
+		}
+		failed++
+		if status == CollectorStatusOk || statusRank(s) > statusRank(status) {
+			status = s
+		}
 	}
-	// set collector execution status
-	c.status = status
+	if failed > 0 && failed < len(statuses) {
+		return CollectorStatusPartial
+	}
+	return status
+}
+
+// statusRank orders the failure statuses by relevance: an invalid login explains the timeouts and errors.
+func statusRank(status int) int {
+	switch status {
+	case CollectorStatusInvalidLogin:
+		return 2
+	case CollectorStatusTimeout:
+		return 1
+	}
+	return 0
+}
+
+// errorStatus returns the status of an execution that failed with the error: timeout if the context has expired
+// (drivers may return their own error when the query is interrupted), invalid login if the driver recognizes a login
+// error in the error or any error it wraps, else error.
+func errorStatus(ctx context.Context, err error, sql_driver *SqlDriver) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return CollectorStatusTimeout
+	}
+	if sql_driver != nil && sql_driver.CheckLoginError != nil {
+		for e := err; e != nil; e = errors.Unwrap(e) {
+			if sql_driver.CheckLoginError(e) {
+				return CollectorStatusInvalidLogin
+			}
+		}
+	}
+	return CollectorStatusError
 }
 
 // newCachingCollector returns a new Collector wrapping the provided raw Collector.
 func newCachingCollector(rawColl *collector) Collector {
 	cc := &cachingCollector{
-		rawColl:     rawColl,
-		minInterval: time.Duration(rawColl.config.MinInterval),
-		cacheSem:    make(chan time.Time, 1),
+		rawColl:      rawColl,
+		minInterval:  time.Duration(rawColl.config.MinInterval),
+		cacheSem:     make(chan time.Time, 1),
+		maxStaleness: time.Duration(rawColl.config.MaxStaleness),
 	}
 	cc.cacheSem <- time.Time{}
 	return cc
@@ -161,6 +272,32 @@ type cachingCollector struct {
 	cacheSem chan time.Time
 	// Metrics saved from the last Collect() call.
 	cache []Metric
+
+	// stale_while_revalidate: cache refreshed in background, served until maxStaleness (zero if not set). refreshing
+	// is protected by cacheSem.
+	maxStaleness    time.Duration
+	refreshing      bool
+	cacheAge        atomic.Int64
+	refreshFailures atomic.Int64
+
+	// cache saved to disk (global cache_dir), empty if not set
+	cacheTarget string
+	cacheFile   string
+}
+
+// cacheStats is implemented by collectors serving cached metrics refreshed in background.
+type cacheStats interface {
+	// CacheStats returns the age of the metrics returned by the last Collect() call and the number of failed refreshes;
+	// ok is false if the collector doesn't refresh in background.
+	CacheStats() (age time.Duration, failures int64, ok bool)
+}
+
+// CacheStats implements cacheStats.
+func (cc *cachingCollector) CacheStats() (time.Duration, int64, bool) {
+	if cc.maxStaleness == 0 {
+		return 0, 0, false
+	}
+	return time.Duration(cc.cacheAge.Load()), cc.refreshFailures.Load(), true
 }
 
 // GetName implement GetName for cachingCollector
@@ -172,13 +309,13 @@ func (cc *cachingCollector) Name() (id string) {
 // GetStatus implement GetStatus for cachingCollector
 // obtain the status of collector scripts execution
 func (cc *cachingCollector) Status() int {
-	return cc.rawColl.status
+	return cc.rawColl.Status()
 }
 
 // SetStatus implement SetStatus for cachingCollector
 // Set the status of collector scripts execution
 func (cc *cachingCollector) SetStatus(status int) {
-	cc.rawColl.status = status
+	cc.rawColl.SetStatus(status)
 }
 
 // Collect implements Collector.
@@ -188,6 +325,7 @@ func (cc *cachingCollector) Collect(
 	symbols_table map[string]interface{},
 	ch chan<- Metric) {
 	if ctx.Err() != nil {
+		cc.rawColl.lastError.record(errorStatus(ctx, ctx.Err(), nil), ctx.Err())
 		ch <- NewInvalidMetric(cc.rawColl.logContext, ctx.Err())
 		return
 	}
@@ -196,7 +334,9 @@ func (cc *cachingCollector) Collect(
 	select {
 	case cacheTime := <-cc.cacheSem:
 		// Have the lock.
-		if age := collTime.Sub(cacheTime); age > cc.minInterval {
+		if cc.maxStaleness > 0 && !cacheTime.IsZero() {
+			cc.collectStale(ctx, conn, symbols_table, collTime.Sub(cacheTime), ch)
+		} else if age := collTime.Sub(cacheTime); age > cc.minInterval {
 			// Cache contents are older than minInterval, collect fresh metrics, cache them and pipe them through.
 			var logCtx []interface{}
 
@@ -204,17 +344,31 @@ func (cc *cachingCollector) Collect(
 			logCtx = append(logCtx, "msg", fmt.Sprintf("Collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs",
 				cc.minInterval.Seconds(), age.Seconds()))
 			cc.rawColl.logger.Debug("stacked", logCtx...)
+			var (
+				status int
+				err    error
+			)
 			cacheChan := make(chan Metric, capMetricChan)
 			cc.cache = make([]Metric, 0, len(cc.cache))
 			go func() {
-				cc.rawColl.Collect(ctx, conn, symbols_table, cacheChan)
+				status, err = cc.rawColl.collect(ctx, conn, symbols_table, cacheChan)
 				close(cacheChan)
 			}()
 			for metric := range cacheChan {
 				cc.cache = append(cc.cache, metric)
 				ch <- metric
 			}
-			cacheTime = collTime
+			cc.rawColl.lastError.record(status, err)
+			// stale_while_revalidate: only a successful collection is cached
+			if cc.maxStaleness == 0 || status == CollectorStatusOk {
+				cacheTime = collTime
+				cc.cacheAge.Store(0)
+				if status == CollectorStatusOk {
+					cc.saveCache(cacheTime)
+				}
+			} else {
+				cc.cache = nil
+			}
 		} else {
 			var logCtx []interface{}
 
@@ -232,6 +386,79 @@ func (cc *cachingCollector) Collect(
 	case <-ctx.Done():
 		// Context closed, record an error and return
 		// TODO: increment an error counter
+		cc.rawColl.lastError.record(errorStatus(ctx, ctx.Err(), nil), ctx.Err())
 		ch <- NewInvalidMetric(cc.rawColl.logContext, ctx.Err())
 	}
 }
+
+// collectStale returns the cached metrics unless they are older than max_staleness, and starts a refresh of the cache
+// in background if they are older than min_interval. Called with the cache lock.
+func (cc *cachingCollector) collectStale(
+	ctx context.Context,
+	conn *sql.DB,
+	symbols_table map[string]interface{},
+	age time.Duration,
+	ch chan<- Metric) {
+	cc.cacheAge.Store(int64(age))
+	if age > cc.minInterval && !cc.refreshing {
+		cc.refreshing = true
+		// the refresh outlives the scrape: it keeps the values of its context but not its deadline, and has its own slot
+		// of the query limit.
+		go cc.refresh(withOwnQuerySlot(context.WithoutCancel(ctx)), conn, maps.Clone(symbols_table))
+	}
+	if age > cc.maxStaleness {
+		ch <- NewInvalidMetric(cc.rawColl.logContext,
+			fmt.Errorf("cached metrics dropped: cache_age=%.3fs greater than max_staleness=%.3fs", age.Seconds(), cc.maxStaleness.Seconds()))
+		return
+	}
+	var logCtx []interface{}
+
+	logCtx = append(logCtx, cc.rawColl.logContext...)
+	logCtx = append(logCtx, "msg", fmt.Sprintf("Returning cached metrics: min_interval=%.3fs cache_age=%.3fs",
+		cc.minInterval.Seconds(), age.Seconds()))
+	cc.rawColl.logger.Debug("stacked", logCtx...)
+	for _, metric := range cc.cache {
+		ch <- metric
+	}
+}
+
+// refresh collects fresh metrics in background, within min_interval, and replaces the cache only if the collection
+// succeeded: a failed refresh keeps the previous metrics, until they are older than max_staleness. The status of the
+// collector is only set once the refresh is done, with the cache lock.
+func (cc *cachingCollector) refresh(ctx context.Context, conn *sql.DB, symbols_table map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(ctx, cc.minInterval)
+	defer cancel()
+
+	var (
+		status int
+		err    error
+	)
+	collTime := time.Now()
+	metrics := make([]Metric, 0)
+	cacheChan := make(chan Metric, capMetricChan)
+	go func() {
+		status, err = cc.rawColl.collect(ctx, conn, symbols_table, cacheChan)
+		close(cacheChan)
+	}()
+	for metric := range cacheChan {
+		metrics = append(metrics, metric)
+	}
+
+	var logCtx []interface{}
+	logCtx = append(logCtx, cc.rawColl.logContext...)
+	cacheTime := <-cc.cacheSem
+	cc.rawColl.lastError.record(status, err)
+	if status == CollectorStatusOk {
+		cc.cache = metrics
+		cacheTime = collTime
+		cc.saveCache(cacheTime)
+		logCtx = append(logCtx, "msg", fmt.Sprintf("Cache refreshed in %.3fs", time.Since(collTime).Seconds()))
+		cc.rawColl.logger.Debug("stacked", logCtx...)
+	} else {
+		cc.refreshFailures.Add(1)
+		logCtx = append(logCtx, "msg", fmt.Sprintf("Cache refresh failed with status=%d, keeping cached metrics", status))
+		cc.rawColl.logger.Warn("stacked", logCtx...)
+	}
+	cc.refreshing = false
+	cc.cacheSem <- cacheTime
+}
@@ -5,11 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -89,6 +95,19 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		if coll.MinInterval < 0 {
 			coll.MinInterval = c.Globals.MinInterval
 		}
+		if coll.StaleWhileRevalidate {
+			if coll.MinInterval == 0 {
+				return fmt.Errorf("stale_while_revalidate requires a min_interval for collector %q", coll.Name)
+			}
+			// Default to three refresh intervals.
+			if coll.MaxStaleness == 0 {
+				coll.MaxStaleness = 3 * coll.MinInterval
+			}
+			if coll.MaxStaleness < coll.MinInterval {
+				return fmt.Errorf("max_staleness (%s) lower than min_interval (%s) for collector %q",
+					coll.MaxStaleness, coll.MinInterval, coll.Name)
+			}
+		}
 		if found_cc, found := colls[coll.Name]; found {
 			var (
 				err                      error
@@ -138,9 +157,15 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 				query.metrics = append(query.metrics, metric)
 			} else {
 				// For literal queries generate a QueryConfig with a name based off collector and metric name.
+				tmpl, err := parseQueryTemplate(metric.Name, metric.QueryLiteral)
+				if err != nil {
+					return fmt.Errorf("%s in metric %q of collector %q", err, metric.Name, coll.Name)
+				}
 				metric.query = &QueryConfig{
-					Name:  metric.Name,
-					Query: metric.QueryLiteral,
+					Name:     metric.Name,
+					Query:    metric.QueryLiteral,
+					Params:   metric.QueryParams,
+					template: tmpl,
 				}
 			}
 		}
@@ -232,6 +257,13 @@ collectors:
 		if t.ScrapeTimeout == 0 {
 			t.ScrapeTimeout = c.Globals.ScrapeTimeout
 		}
+		if t.Scheduler == 0 {
+			t.Scheduler = c.Globals.Scheduler
+		}
+		// the key of an encrypted password is only sent by the scrapes (auth_key parameter).
+		if t.DSN != "template" && scheduledTarget(t, t.collectors) && t.hasEncryptedPassword() {
+			return fmt.Errorf("target '%s': encrypted password can't be used with scheduler_interval (no auth_key in background)", t.Name)
+		}
 
 		// skip targets with DSN "template"
 		if t.DSN == "template" {
@@ -380,13 +412,17 @@ func (c *Config) loadTargetsFiles(targetFilepath []string) error {
 
 // GlobalConfig contains globally applicable defaults.
 type GlobalConfig struct {
-	MinInterval   model.Duration `yaml:"min_interval" json:"min_interval"`                   // minimum interval between query executions, default is 0
-	ScrapeTimeout model.Duration `yaml:"scrape_timeout" json:"scrape_timeout"`               // per-scrape timeout, global
-	TimeoutOffset model.Duration `yaml:"scrape_timeout_offset" json:"scrape_timeout_offset"` // offset to subtract from timeout in seconds
-	MaxConns      int            `yaml:"max_connections" json:"max_connections"`             // maximum number of open connections to any one target
-	MaxIdleConns  int            `yaml:"max_idle_connections" json:"max_idle_connections"`   // maximum number of idle connections to any one target
-	NameSpace     string         `yaml:"namespace" json:"namespace"`                         // prefix to add to all metric name (prifx + '_')
-	ExporterName  string         `yaml:"exporter_name,omitempty" json:"exporter_name,omitempty"`
+	MinInterval   model.Duration  `yaml:"min_interval" json:"min_interval"`                     // minimum interval between query executions, default is 0
+	ScrapeTimeout model.Duration  `yaml:"scrape_timeout" json:"scrape_timeout"`                 // per-scrape timeout, global
+	TimeoutOffset model.Duration  `yaml:"scrape_timeout_offset" json:"scrape_timeout_offset"`   // offset to subtract from timeout in seconds
+	MaxConns      int             `yaml:"max_connections" json:"max_connections"`               // maximum number of open connections to any one target
+	MaxIdleConns  int             `yaml:"max_idle_connections" json:"max_idle_connections"`     // maximum number of idle connections to any one target
+	MaxQueries    int             `yaml:"max_concurrent_queries" json:"max_concurrent_queries"` // maximum number of queries running concurrently on any one target, default 0 (no limit)
+	Scheduler     model.Duration  `yaml:"scheduler_interval" json:"scheduler_interval"`         // interval of background collection of targets, default 0 (collect on scrape)
+	CacheDir      string          `yaml:"cache_dir,omitempty" json:"cache_dir,omitempty"`       // directory to save the cache of min_interval collectors across restarts
+	NameSpace     string          `yaml:"namespace" json:"namespace"`                           // prefix to add to all metric name (prifx + '_')
+	ExporterName  string          `yaml:"exporter_name,omitempty" json:"exporter_name,omitempty"`
+	Variables     VariablesConfig `yaml:"variables,omitempty" json:"variables,omitempty"` // default variables for all targets
 
 	UpMetricHelp        string `yaml:"up_help,omitempty" json:"up_help,omitempty"`
 	ScrapeDurationHelp  string `yaml:"scrape_duration_help,omitempty" json:"scrape_duration_help,omitempty"`
@@ -425,6 +461,9 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if g.TimeoutOffset <= 0 {
 		return fmt.Errorf("global.scrape_timeout_offset must be strictly positive, have %s", g.TimeoutOffset)
 	}
+	if g.MaxQueries < 0 {
+		return fmt.Errorf("global.max_concurrent_queries must be positive, have %d", g.MaxQueries)
+	}
 
 	return checkOverflow(g.XXX, "global")
 }
@@ -446,20 +485,64 @@ type TargetConfig struct {
 	TargetsFiles  []string          `yaml:"targets_files,omitempty" json:"targets_files,omitempty"` // slice of path and pattern for files that contains targets
 	AuthName      string            `yaml:"auth_name,omitempty" json:"auth_name,omitempty"`
 	AuthConfig    AuthConfig        `yaml:"auth_config,omitempty" json:"auth_config,omitempty"`
+	Driver        string            `yaml:"driver,omitempty" json:"driver,omitempty"`                                 // name of the sql driver to use; default from dsn scheme
+	Variables     VariablesConfig   `yaml:"variables,omitempty" json:"variables,omitempty"`                           // variables for query templates, params and static labels
+	MaxQueries    int               `yaml:"max_concurrent_queries,omitempty" json:"max_concurrent_queries,omitempty"` // maximum number of queries running concurrently, overrides global value
+	Scheduler     model.Duration    `yaml:"scheduler_interval,omitempty" json:"scheduler_interval,omitempty"`         // interval of background collection, overrides global value
 
 	collectors []*CollectorConfig // resolved collector references
 	fromFile   string             // filepath if loaded from targets_files pattern
 	targetType int
+	driver     *SqlDriver // resolved sql driver
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// CollectorVariables returns the variables of the target for a collector: global ones, overridden by the collector
+// defaults, overridden by the target ones.
+func (t *TargetConfig) CollectorVariables(gc *GlobalConfig, cc *CollectorConfig) VariablesConfig {
+	vars := make(VariablesConfig, len(gc.Variables)+len(cc.Variables)+len(t.Variables))
+	maps.Copy(vars, gc.Variables)
+	maps.Copy(vars, cc.Variables)
+	maps.Copy(vars, t.Variables)
+	return vars
+}
+
+// MaxConcurrentQueries returns the maximum number of queries running concurrently on the target: target value if set,
+// else the global one; 0 means no limit.
+func (t *TargetConfig) MaxConcurrentQueries(gc *GlobalConfig) int {
+	if t.MaxQueries > 0 {
+		return t.MaxQueries
+	}
+	return gc.MaxQueries
+}
+
 // Collectors returns the collectors referenced by the target, resolved.
 func (t *TargetConfig) Collectors() []*CollectorConfig {
 	return t.collectors
 }
 
+// SqlDriver returns the backend used to connect to the target, resolved from the driver parameter or from the dsn.
+func (t *TargetConfig) SqlDriver() (*SqlDriver, error) {
+	if t.driver == nil {
+		d, err := FindSqlDriver(t.Driver, string(t.DSN))
+		if err != nil {
+			return nil, fmt.Errorf("target '%s': %s", t.Name, err)
+		}
+		t.driver = d
+	}
+	return t.driver, nil
+}
+
+// hasEncryptedPassword returns true if the password of the target, in the data source name or in its authentication,
+// is encrypted.
+func (t *TargetConfig) hasEncryptedPassword() bool {
+	dsn := strings.ToLower(string(t.DSN))
+	return strings.HasPrefix(string(t.AuthConfig.Password), "/encrypted/") ||
+		strings.Contains(dsn, "/encrypted/") || strings.Contains(dsn, "%2fencrypted%2f")
+}
+
 // set fromFile for target when read from targets_files directive
 func (t *TargetConfig) setFromFile(file_path string) {
 	t.fromFile = file_path
@@ -488,6 +571,20 @@ func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			}
 		}
 		checkCollectorRefs(t.CollectorRefs, "target")
+		if t.MaxQueries < 0 {
+			return fmt.Errorf("target '%s': max_concurrent_queries must be positive, have %d", t.Name, t.MaxQueries)
+		}
+
+		// check that the driver is available; template dsn is only checked for driver name.
+		if t.DSN == "template" {
+			if t.Driver != "" {
+				if _, err := FindSqlDriver(t.Driver, ""); err != nil {
+					return fmt.Errorf("target '%s': %s", t.Name, err)
+				}
+			}
+		} else if _, err := t.SqlDriver(); err != nil {
+			return err
+		}
 
 		if len(t.Labels) > 0 {
 			err := t.checkLabelCollisions()
@@ -514,6 +611,10 @@ type dumpTargetConfig struct {
 	TargetsFiles  []string          `yaml:"targets_files,omitempty" json:"targets_files,omitempty"` // slice of path and pattern for files that contains targets
 	AuthName      string            `yaml:"auth_name,omitempty" json:"auth_name,omitempty"`
 	AuthConfig    AuthConfig        `yaml:"auth_config,omitempty" json:"auth_config,omitempty"`
+	Driver        string            `yaml:"driver,omitempty" json:"driver,omitempty"`
+	Variables     VariablesConfig   `yaml:"variables,omitempty" json:"variables,omitempty"`
+	MaxQueries    int               `yaml:"max_concurrent_queries,omitempty" json:"max_concurrent_queries,omitempty"`
+	Scheduler     model.Duration    `yaml:"scheduler_interval,omitempty" json:"scheduler_interval,omitempty"`
 }
 
 func (t *TargetConfig) buildDumpTargetconfig() *dumpTargetConfig {
@@ -547,6 +648,10 @@ func (t *TargetConfig) buildDumpTargetconfig() *dumpTargetConfig {
 		TargetsFiles:  t.TargetsFiles,
 		AuthName:      t.AuthName,
 		AuthConfig:    t.AuthConfig,
+		Driver:        t.Driver,
+		Variables:     t.Variables,
+		MaxQueries:    t.MaxQueries,
+		Scheduler:     t.Scheduler,
 	}
 }
 
@@ -581,8 +686,15 @@ func (t *TargetConfig) Clone(dsn string, auth_name string) (*TargetConfig, error
 		Labels:        t.Labels,
 		collectors:    t.collectors,
 		ScrapeTimeout: t.ScrapeTimeout,
+		Driver:        t.Driver,
+		Variables:     t.Variables,
+		MaxQueries:    t.MaxQueries,
 	}
-	if _, err := BuildConnection(nil,
+	driver, err := new.SqlDriver()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := driver.BuildConnection(nil,
 		string(new.DSN),
 		t.AuthConfig,
 		nil, true,
@@ -632,11 +744,17 @@ func (t *TargetConfig) Clone(dsn string, auth_name string) (*TargetConfig, error
 
 // CollectorConfig defines a set of metrics and how they are collected.
 type CollectorConfig struct {
-	Name        string          `yaml:"collector_name" json:"collector_name"`                 // name of this collector
-	NameSpace   string          `yaml:"namespace" json:"namespace"`                           // prefix to add to all metric name (prifx + '_')
-	MinInterval model.Duration  `yaml:"min_interval,omitempty" json:"min_interval,omitempty"` // minimum interval between query executions
-	Metrics     []*MetricConfig `yaml:"metrics" json:"metrics"`                               // metrics/queries defined by this collector
-	Queries     []*QueryConfig  `yaml:"queries,omitempty" json:"queries,omitempty"`           // named queries defined by this collector
+	Name        string             `yaml:"collector_name" json:"collector_name"`                             // name of this collector
+	NameSpace   string             `yaml:"namespace" json:"namespace"`                                       // prefix to add to all metric name (prifx + '_')
+	MinInterval model.Duration     `yaml:"min_interval,omitempty" json:"min_interval,omitempty"`             // minimum interval between query executions
+	Metrics     []*MetricConfig    `yaml:"metrics" json:"metrics"`                                           // metrics/queries defined by this collector
+	Queries     []*QueryConfig     `yaml:"queries,omitempty" json:"queries,omitempty"`                       // named queries defined by this collector
+	Variables   VariablesConfig    `yaml:"variables,omitempty" json:"variables,omitempty"`                   // default variables, overridden by target ones
+	PerDatabase *PerDatabaseConfig `yaml:"per_database,omitempty" json:"per_database,omitempty"`             // run the queries in each database of the server
+	Scheduler   model.Duration     `yaml:"scheduler_interval,omitempty" json:"scheduler_interval,omitempty"` // interval of background collection, overrides target value
+	// min_interval cache refreshed in background, served until max_staleness
+	StaleWhileRevalidate bool           `yaml:"stale_while_revalidate,omitempty" json:"stale_while_revalidate,omitempty"`
+	MaxStaleness         model.Duration `yaml:"max_staleness,omitempty" json:"max_staleness,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX      map[string]interface{} `yaml:",inline" json:"-"`
@@ -661,6 +779,40 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return fmt.Errorf("no metrics defined for collector %q", c.Name)
 	}
 
+	// info metrics names must not clash with other metrics of the collector.
+	for _, im := range c.Metrics {
+		if !im.info {
+			continue
+		}
+		for _, m := range c.Metrics {
+			if m == im {
+				continue
+			}
+			for _, name := range m.sampleNames() {
+				if slices.Contains(im.sampleNames(), name) {
+					return fmt.Errorf("info metric %q clashes with metric %q in collector %q", im.Name, m.Name, c.Name)
+				}
+			}
+		}
+	}
+
+	// per database collectors: database label added to all metrics, filled by the exporter.
+	if pd := c.PerDatabase; pd != nil {
+		for _, q := range c.Queries {
+			if q.MinInterval > 0 {
+				return fmt.Errorf("min_interval can't be set for query %q of per_database collector %q: use collector min_interval", q.Name, c.Name)
+			}
+		}
+		for _, m := range c.Metrics {
+			if m.ValueLabel == pd.Label || (m.Histogram != nil && m.Histogram.BucketLabel == pd.Label) {
+				return fmt.Errorf("label %q of per_database collector %q already used by metric %q", pd.Label, c.Name, m.Name)
+			}
+			if !slices.Contains(m.KeyLabels, pd.Label) {
+				m.KeyLabels = append(m.KeyLabels, pd.Label)
+			}
+		}
+	}
+
 	// // Set metric.query for all metrics: resolve query references (if any) and generate QueryConfigs for literal queries.
 	// queries := make(map[string]*QueryConfig, len(c.Queries))
 	// for _, query := range c.Queries {
@@ -702,9 +854,23 @@ type MetricConfig struct {
 	Values       []string          `yaml:"values" json:"values"`                                   // expose each of these columns as a value, keyed by column name
 	QueryLiteral string            `yaml:"query,omitempty" json:"query,omitempty"`                 // a literal query
 	QueryRef     string            `yaml:"query_ref,omitempty" json:"query_ref,omitempty"`         // references a query in the query map
+	QueryParams  []string          `yaml:"query_params,omitempty" json:"query_params,omitempty"`   // symbols bound to literal query placeholders
+	Histogram    *HistogramConfig  `yaml:"histogram,omitempty" json:"histogram,omitempty"`         // buckets, sum and count columns for histogram type
+	Aggregate    *AggregateConfig  `yaml:"aggregate,omitempty" json:"aggregate,omitempty"`         // buckets or quantiles to fold all rows into a histogram or summary
+	States       []string          `yaml:"states,omitempty" json:"states,omitempty"`               // allowed values of the state column for stateset type
+
+	Transforms map[string]*TransformConfig `yaml:"transforms,omitempty" json:"transforms,omitempty"`   // value column conversions (unit, scale, offset, expression)
+	LabelRules map[string]*LabelRuleConfig `yaml:"label_rules,omitempty" json:"label_rules,omitempty"` // key label values rewriting (trim, replace, case, map, default)
+
+	TimestampColumn   string         `yaml:"timestamp_column,omitempty" json:"timestamp_column,omitempty"`     // column holding the sample timestamp
+	TimestampLocation string         `yaml:"timestamp_location,omitempty" json:"timestamp_location,omitempty"` // time zone of timestamp column without time zone
+	TimestampMaxAge   model.Duration `yaml:"timestamp_max_age,omitempty" json:"timestamp_max_age,omitempty"`   // drop samples with older timestamp
 
 	valueType prometheus.ValueType // TypeString converted to prometheus.ValueType
 	query     *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
+	location  *time.Location       // TimestampLocation loaded
+	info      bool                 // info metric: key labels with constant value 1
+	stateset  bool                 // stateset metric: one series per state, 1 for the current one
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -715,6 +881,30 @@ func (m *MetricConfig) ValueType() prometheus.ValueType {
 	return m.valueType
 }
 
+// IsInfo returns true for info metric (string columns exposed as labels of a constant 1 value).
+func (m *MetricConfig) IsInfo() bool {
+	return m.info
+}
+
+// IsStateSet returns true for stateset metric (string column mapped to one series per allowed state).
+func (m *MetricConfig) IsStateSet() bool {
+	return m.stateset
+}
+
+// sampleNames returns the names of the series exposed for the metric (e.g. name_bucket, name_sum, name_count for a
+// histogram).
+func (m *MetricConfig) sampleNames() []string {
+	switch {
+	case m.Histogram != nil || (m.Aggregate != nil && !m.Aggregate.summary):
+		return []string{m.Name, m.Name + "_bucket", m.Name + "_sum", m.Name + "_count"}
+	case m.Aggregate != nil:
+		return []string{m.Name, m.Name + "_sum", m.Name + "_count"}
+	case m.info:
+		return []string{m.Name, strings.TrimSuffix(m.Name, "_info")}
+	}
+	return []string{m.Name}
+}
+
 // Query returns the query defined (as a literal) or referenced by the metric.
 func (m *MetricConfig) Query() *QueryConfig {
 	return m.query
@@ -741,16 +931,66 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if (m.QueryLiteral == "") == (m.QueryRef == "") {
 		return fmt.Errorf("exactly one of query and query_ref must be specified for metric %q", m.Name)
 	}
+	if len(m.QueryParams) > 0 && m.QueryRef != "" {
+		return fmt.Errorf("query_params can't be used with query_ref for metric %q: set params in query definition", m.Name)
+	}
+	if err := checkQueryParams(m.QueryParams, m.Name); err != nil {
+		return err
+	}
 
 	switch strings.ToLower(m.TypeString) {
 	case "counter":
 		m.valueType = prometheus.CounterValue
 	case "gauge":
 		m.valueType = prometheus.GaugeValue
+	case "histogram":
+		// no prometheus.ValueType for histogram: metric is built from Histogram or Aggregate config.
+		m.valueType = prometheus.UntypedValue
+		if (m.Histogram == nil) == (m.Aggregate == nil) {
+			return fmt.Errorf("exactly one of histogram and aggregate must be specified for histogram metric %q", m.Name)
+		}
+		if m.Aggregate != nil && len(m.Aggregate.Quantiles) > 0 {
+			return fmt.Errorf("quantiles can't be used for histogram metric %q", m.Name)
+		}
+	case "summary":
+		// no prometheus.ValueType for summary: metric is built from Aggregate config.
+		m.valueType = prometheus.UntypedValue
+		if m.Aggregate == nil {
+			return fmt.Errorf("missing aggregate definition for summary metric %q", m.Name)
+		}
+		if len(m.Aggregate.Buckets) > 0 {
+			return fmt.Errorf("buckets can't be used for summary metric %q", m.Name)
+		}
+		m.Aggregate.summary = true
+	case "info":
+		// OpenMetrics info: exposed as a gauge with constant value 1 and name suffixed by "_info"
+		m.valueType = prometheus.GaugeValue
+		m.info = true
+		if !strings.HasSuffix(m.Name, "_info") {
+			m.Name += "_info"
+		}
+	case "stateset":
+		// OpenMetrics stateset: exposed as a gauge with one series per state, labeled by metric name by default
+		m.valueType = prometheus.GaugeValue
+		m.stateset = true
 	default:
 		return fmt.Errorf("unsupported metric type: %s", m.TypeString)
 	}
+	if len(m.States) > 0 && !m.stateset {
+		return fmt.Errorf("states definition is only allowed for stateset metric %q", m.Name)
+	}
+	if m.Histogram != nil && m.valueType != prometheus.UntypedValue {
+		return fmt.Errorf("histogram definition is only allowed for histogram metric %q", m.Name)
+	}
+	if m.Aggregate != nil && m.valueType != prometheus.UntypedValue {
+		return fmt.Errorf("aggregate definition is only allowed for histogram or summary metric %q", m.Name)
+	}
 
+	if m.stateset {
+		if err := m.checkStates(); err != nil {
+			return err
+		}
+	}
 	m.ValueLabel = strings.ToLower(m.ValueLabel)
 
 	// Check for duplicate key labels
@@ -768,16 +1008,67 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return fmt.Errorf("duplicate label %q (defined in both key_labels and value_label) for metric %q", li, m.Name)
 		}
 	}
+	if err := m.checkLabelRules(); err != nil {
+		return err
+	}
+	for name, value := range m.StaticLabels {
+		if _, err := parseLabelTemplate(name, value); err != nil {
+			return fmt.Errorf("%s for metric %q", err, m.Name)
+		}
+	}
+
+	if m.info {
+		if len(m.Values) > 0 || m.ValueLabel != "" {
+			return fmt.Errorf("values and value_label can't be used for info metric %q: value is always 1", m.Name)
+		}
+		if len(m.KeyLabels) == 0 {
+			return fmt.Errorf("key_labels must be defined for info metric %q", m.Name)
+		}
+		if err := m.checkTimestamp(); err != nil {
+			return err
+		}
+		if err := m.checkTransforms(); err != nil {
+			return err
+		}
+		return checkOverflow(m.XXX, "metric")
+	}
+
+	if m.Histogram != nil {
+		if len(m.Values) > 0 || m.ValueLabel != "" {
+			return fmt.Errorf("values and value_label can't be used for histogram metric %q: use histogram definition", m.Name)
+		}
+		for _, li := range m.KeyLabels {
+			if li == m.Histogram.BucketLabel {
+				return fmt.Errorf("duplicate label %q (defined in both key_labels and bucket_label) for metric %q", li, m.Name)
+			}
+		}
+		if err := m.checkTimestamp(); err != nil {
+			return err
+		}
+		if err := m.checkTransforms(); err != nil {
+			return err
+		}
+		return checkOverflow(m.XXX, "metric")
+	}
 
 	if len(m.Values) == 0 {
 		return fmt.Errorf("no values defined for metric %q", m.Name)
 	}
+	if m.Aggregate != nil && (len(m.Values) > 1 || m.ValueLabel != "") {
+		return fmt.Errorf("exactly one value (the observed column) must be defined for aggregated metric %q", m.Name)
+	}
 
 	for i, value := range m.Values {
 		if value != "" {
 			m.Values[i] = strings.ToLower(value)
 		}
 	}
+	if err := m.checkTimestamp(); err != nil {
+		return err
+	}
+	if err := m.checkTransforms(); err != nil {
+		return err
+	}
 
 	if len(m.Values) > 1 {
 		// Multiple value columns but no value label to identify them
@@ -790,12 +1081,438 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(m.XXX, "metric")
 }
 
+// checkLabelRules checks that label rules are defined for key labels of the metric, and converts their names to
+// lower case.
+func (m *MetricConfig) checkLabelRules() error {
+	if len(m.LabelRules) == 0 {
+		return nil
+	}
+	rules := make(map[string]*LabelRuleConfig, len(m.LabelRules))
+	for label, rule := range m.LabelRules {
+		label = strings.ToLower(label)
+		if !slices.Contains(m.KeyLabels, label) {
+			return fmt.Errorf("label rule defined for %q that is not a key label of metric %q", label, m.Name)
+		}
+		if rule == nil {
+			return fmt.Errorf("empty label rule for %q of metric %q", label, m.Name)
+		}
+		if _, found := rules[label]; found {
+			return fmt.Errorf("duplicate label rule for %q of metric %q", label, m.Name)
+		}
+		rules[label] = rule
+	}
+	m.LabelRules = rules
+	return nil
+}
+
+// checkTransforms checks that transforms are defined for value columns of the metric, and converts their names to
+// lower case.
+func (m *MetricConfig) checkTransforms() error {
+	if len(m.Transforms) == 0 {
+		return nil
+	}
+	if m.stateset {
+		return fmt.Errorf("transforms can't be used for stateset metric %q", m.Name)
+	}
+	transforms := make(map[string]*TransformConfig, len(m.Transforms))
+	for column, t := range m.Transforms {
+		column = strings.ToLower(column)
+		if !slices.Contains(m.Values, column) {
+			return fmt.Errorf("transform defined for column %q that is not a value of metric %q", column, m.Name)
+		}
+		if t == nil {
+			return fmt.Errorf("empty transform for column %q of metric %q", column, m.Name)
+		}
+		if _, found := transforms[column]; found {
+			return fmt.Errorf("duplicate transform for column %q of metric %q", column, m.Name)
+		}
+		transforms[column] = t
+	}
+	m.Transforms = transforms
+	return nil
+}
+
+// transform returns the value of the column converted by its transform, if any.
+func (m *MetricConfig) transform(column string, value float64) float64 {
+	if t, ok := m.Transforms[column]; ok {
+		return t.Apply(value)
+	}
+	return value
+}
+
+// checkStates checks the states of a stateset metric: exactly one value column holding the state, and sets the label
+// exposing the states to the metric name if value_label is not set.
+func (m *MetricConfig) checkStates() error {
+	if len(m.States) == 0 {
+		return fmt.Errorf("states must be defined for stateset metric %q", m.Name)
+	}
+	if len(m.Values) != 1 {
+		return fmt.Errorf("exactly one value (the state column) must be defined for stateset metric %q", m.Name)
+	}
+	for i, state := range m.States {
+		if state == "" {
+			return fmt.Errorf("empty state for stateset metric %q", m.Name)
+		}
+		for _, other := range m.States[i+1:] {
+			if strings.EqualFold(state, other) {
+				return fmt.Errorf("duplicate state %q for stateset metric %q", state, m.Name)
+			}
+		}
+	}
+	if m.ValueLabel == "" {
+		m.ValueLabel = m.Name
+	}
+	return nil
+}
+
+// checkTimestamp checks the timestamp_* parameters of the metric and loads the timestamp location.
+func (m *MetricConfig) checkTimestamp() error {
+	if m.TimestampColumn == "" {
+		if m.TimestampLocation != "" || m.TimestampMaxAge != 0 {
+			return fmt.Errorf("timestamp_location and timestamp_max_age require timestamp_column for metric %q", m.Name)
+		}
+		return nil
+	}
+	if m.valueType != prometheus.CounterValue && m.valueType != prometheus.GaugeValue {
+		return fmt.Errorf("timestamp_column can only be used for counter or gauge metric %q", m.Name)
+	}
+	m.TimestampColumn = strings.ToLower(m.TimestampColumn)
+	if slices.Contains(m.KeyLabels, m.TimestampColumn) || slices.Contains(m.Values, m.TimestampColumn) {
+		return fmt.Errorf("timestamp_column %q is also used as key label or value for metric %q", m.TimestampColumn, m.Name)
+	}
+	if m.TimestampLocation != "" {
+		loc, err := time.LoadLocation(m.TimestampLocation)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp_location for metric %q: %s", m.Name, err)
+		}
+		m.location = loc
+	}
+	if m.TimestampMaxAge < 0 {
+		return fmt.Errorf("invalid negative timestamp_max_age for metric %q", m.Name)
+	}
+	return nil
+}
+
+// HistogramConfig defines how a histogram metric is built from the columns of the query result. Buckets are either:
+//
+// * one column per bucket in each row: "buckets" maps the upper bound of each bucket to the column holding its count,
+//
+// * one row per bucket: "bucket_label" is the column holding the upper bound (le) and "bucket_value" the one holding
+// the count; rows with same key labels values are merged in one histogram.
+type HistogramConfig struct {
+	Buckets     map[string]string `yaml:"buckets,omitempty" json:"buckets,omitempty"`           // upper bound => column with the bucket count
+	BucketLabel string            `yaml:"bucket_label,omitempty" json:"bucket_label,omitempty"` // column with the upper bound of the bucket (one row per bucket)
+	BucketValue string            `yaml:"bucket_value,omitempty" json:"bucket_value,omitempty"` // column with the bucket count (one row per bucket)
+	Sum         string            `yaml:"sum,omitempty" json:"sum,omitempty"`                   // column with the sum of observations
+	Count       string            `yaml:"count,omitempty" json:"count,omitempty"`               // column with the count of observations; default +Inf bucket count
+	Cumulative  *bool             `yaml:"cumulative,omitempty" json:"cumulative,omitempty"`     // bucket counts are cumulative (default) or per bucket
+
+	bounds     []float64 // upper bounds of buckets columns, sorted
+	columns    []string  // buckets columns, in bounds order
+	infColumn  string    // column of the +Inf bucket if any
+	cumulative bool
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for HistogramConfig.
+func (h *HistogramConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain HistogramConfig
+	if err := unmarshal((*plain)(h)); err != nil {
+		return err
+	}
+
+	h.cumulative = h.Cumulative == nil || *h.Cumulative
+	h.BucketLabel = strings.ToLower(h.BucketLabel)
+	h.BucketValue = strings.ToLower(h.BucketValue)
+	h.Sum = strings.ToLower(h.Sum)
+	h.Count = strings.ToLower(h.Count)
+
+	if (len(h.Buckets) == 0) == (h.BucketLabel == "") {
+		return fmt.Errorf("exactly one of buckets and bucket_label must be specified for histogram")
+	}
+	if h.BucketLabel != "" {
+		if h.BucketValue == "" {
+			return fmt.Errorf("bucket_value must be specified with bucket_label for histogram")
+		}
+		if err := checkLabel(h.BucketLabel, "histogram bucket_label"); err != nil {
+			return err
+		}
+	} else if h.BucketValue != "" {
+		return fmt.Errorf("bucket_value can only be specified with bucket_label for histogram")
+	}
+
+	type bucket struct {
+		bound  float64
+		column string
+	}
+	buckets := make([]bucket, 0, len(h.Buckets))
+	for le, column := range h.Buckets {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(le), 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket upper bound %q for histogram: %s", le, err)
+		}
+		if column == "" {
+			return fmt.Errorf("empty column for bucket %q of histogram", le)
+		}
+		column = strings.ToLower(column)
+		if math.IsInf(bound, +1) {
+			h.infColumn = column
+			continue
+		}
+		buckets = append(buckets, bucket{bound: bound, column: column})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+	h.bounds = make([]float64, len(buckets))
+	h.columns = make([]string, len(buckets))
+	for i, b := range buckets {
+		h.bounds[i] = b.bound
+		h.columns[i] = b.column
+	}
+
+	return checkOverflow(h.XXX, "histogram")
+}
+
+// ValueColumns returns the columns of the query result used as values (bucket counts, sum and count) by the histogram.
+func (h *HistogramConfig) ValueColumns() []string {
+	columns := make([]string, 0, len(h.columns)+4)
+	columns = append(columns, h.columns...)
+	for _, col := range []string{h.infColumn, h.BucketValue, h.Sum, h.Count} {
+		if col != "" {
+			columns = append(columns, col)
+		}
+	}
+	return columns
+}
+
+// AggregateConfig defines how the rows of the query result are folded by the exporter into a histogram or a summary:
+// each row is an observation of the value column, grouped by key labels values.
+type AggregateConfig struct {
+	Buckets   []float64 `yaml:"buckets,omitempty" json:"buckets,omitempty"`     // histogram upper bounds; default prometheus.DefBuckets
+	Quantiles []float64 `yaml:"quantiles,omitempty" json:"quantiles,omitempty"` // summary quantiles (0 <= q <= 1)
+
+	summary bool // set for summary metric
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AggregateConfig.
+func (a *AggregateConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AggregateConfig
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+
+	// +Inf bucket is implicit
+	a.Buckets = slices.DeleteFunc(a.Buckets, func(b float64) bool { return math.IsInf(b, +1) })
+	sort.Float64s(a.Buckets)
+	for i := 1; i < len(a.Buckets); i++ {
+		if a.Buckets[i] == a.Buckets[i-1] {
+			return fmt.Errorf("duplicate bucket %g in aggregate", a.Buckets[i])
+		}
+	}
+	sort.Float64s(a.Quantiles)
+	for i, q := range a.Quantiles {
+		if q < 0 || q > 1 || math.IsNaN(q) {
+			return fmt.Errorf("invalid quantile %g in aggregate: must be between 0 and 1", q)
+		}
+		if i > 0 && q == a.Quantiles[i-1] {
+			return fmt.Errorf("duplicate quantile %g in aggregate", q)
+		}
+	}
+
+	return checkOverflow(a.XXX, "aggregate")
+}
+
+// unitFactors contains the named unit conversions available for transforms, to get values in base units (seconds,
+// bytes, ratio).
+var unitFactors = map[string]float64{
+	"ns_to_seconds":      1e-9,
+	"us_to_seconds":      1e-6,
+	"ms_to_seconds":      1e-3,
+	"cs_to_seconds":      1e-2,
+	"minutes_to_seconds": 60,
+	"hours_to_seconds":   3600,
+	"days_to_seconds":    86400,
+	"kb_to_bytes":        1024,
+	"mb_to_bytes":        1024 * 1024,
+	"gb_to_bytes":        1024 * 1024 * 1024,
+	"pages2k_to_bytes":   2048,
+	"pages4k_to_bytes":   4096,
+	"pages8k_to_bytes":   8192,
+	"pages16k_to_bytes":  16384,
+	"pages32k_to_bytes":  32768,
+	"percent_to_ratio":   1e-2,
+}
+
+// TransformConfig defines the conversion of a value column, applied in order: unit, multiply, divide, offset and
+// expression.
+type TransformConfig struct {
+	Unit       string   `yaml:"unit,omitempty" json:"unit,omitempty"`             // named unit conversion (e.g. ms_to_seconds)
+	Multiply   *float64 `yaml:"multiply,omitempty" json:"multiply,omitempty"`     // factor the value is multiplied by
+	Divide     *float64 `yaml:"divide,omitempty" json:"divide,omitempty"`         // factor the value is divided by
+	Offset     float64  `yaml:"offset,omitempty" json:"offset,omitempty"`         // added to the value
+	Expression string   `yaml:"expression,omitempty" json:"expression,omitempty"` // arithmetic expression of "value"
+
+	factor     float64         // unit, multiply and divide combined
+	expression valueExpression // Expression compiled
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for TransformConfig.
+func (t *TransformConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TransformConfig
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+
+	t.factor = 1
+	if t.Unit != "" {
+		factor, ok := unitFactors[strings.ToLower(t.Unit)]
+		if !ok {
+			units := make([]string, 0, len(unitFactors))
+			for unit := range unitFactors {
+				units = append(units, unit)
+			}
+			sort.Strings(units)
+			return fmt.Errorf("unknown unit %q in transform (available: %s)", t.Unit, strings.Join(units, ", "))
+		}
+		t.factor = factor
+	}
+	if t.Multiply != nil {
+		t.factor *= *t.Multiply
+	}
+	if t.Divide != nil {
+		if *t.Divide == 0 {
+			return fmt.Errorf("divide can't be 0 in transform")
+		}
+		t.factor /= *t.Divide
+	}
+	if t.Expression != "" {
+		expression, err := compileExpression(t.Expression)
+		if err != nil {
+			return err
+		}
+		t.expression = expression
+	}
+
+	return checkOverflow(t.XXX, "transform")
+}
+
+// Apply returns the value converted by the transform.
+func (t *TransformConfig) Apply(value float64) float64 {
+	value = value*t.factor + t.Offset
+	if t.expression != nil {
+		value = t.expression(value)
+	}
+	return value
+}
+
+// LabelRuleConfig defines how the value of a key label read from the query result is rewritten, applied in order:
+// trim, replace, case, map and default.
+type LabelRuleConfig struct {
+	Trim    bool                  `yaml:"trim,omitempty" json:"trim,omitempty"`       // remove leading and trailing spaces (e.g. padded CHAR columns)
+	Replace []*LabelReplaceConfig `yaml:"replace,omitempty" json:"replace,omitempty"` // regex replacements, in order
+	Case    string                `yaml:"case,omitempty" json:"case,omitempty"`       // "lower" or "upper"
+	Map     map[string]string     `yaml:"map,omitempty" json:"map,omitempty"`         // static value mapping (e.g. "1": primary)
+	Default string                `yaml:"default,omitempty" json:"default,omitempty"` // value used when result is empty
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for LabelRuleConfig.
+func (r *LabelRuleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LabelRuleConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	r.Case = strings.ToLower(r.Case)
+	switch r.Case {
+	case "", "lower", "upper":
+	default:
+		return fmt.Errorf("invalid case %q in label rule: must be lower or upper", r.Case)
+	}
+	for _, replace := range r.Replace {
+		if replace == nil {
+			return fmt.Errorf("empty replace in label rule")
+		}
+	}
+
+	return checkOverflow(r.XXX, "label rule")
+}
+
+// Apply returns the label value rewritten by the rule.
+func (r *LabelRuleConfig) Apply(value string) string {
+	if r.Trim {
+		value = strings.TrimSpace(value)
+	}
+	for _, replace := range r.Replace {
+		value = replace.regex.ReplaceAllString(value, replace.Replacement)
+	}
+	switch r.Case {
+	case "lower":
+		value = strings.ToLower(value)
+	case "upper":
+		value = strings.ToUpper(value)
+	}
+	if mapped, ok := r.Map[value]; ok {
+		value = mapped
+	}
+	if value == "" {
+		value = r.Default
+	}
+	return value
+}
+
+// LabelReplaceConfig defines a regex replacement in a label value: all matches of regex are replaced by replacement,
+// that may reference capture groups ($1, ${name}).
+type LabelReplaceConfig struct {
+	Regex       string `yaml:"regex" json:"regex"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+
+	regex *regexp.Regexp // Regex compiled
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for LabelReplaceConfig.
+func (r *LabelReplaceConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LabelReplaceConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.Regex == "" {
+		return fmt.Errorf("missing regex in label rule replace")
+	}
+	regex, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q in label rule replace: %s", r.Regex, err)
+	}
+	r.regex = regex
+
+	return checkOverflow(r.XXX, "label rule replace")
+}
+
 // QueryConfig defines a named query, to be referenced by one or multiple metrics.
 type QueryConfig struct {
-	Name  string `yaml:"query_name" json:"query_name"` // the query name, to be referenced via `query_ref`
-	Query string `yaml:"query" json:"query"`           // the named query
+	Name   string   `yaml:"query_name" json:"query_name"`             // the query name, to be referenced via `query_ref`
+	Query  string   `yaml:"query" json:"query"`                       // the named query
+	Params []string `yaml:"params,omitempty" json:"params,omitempty"` // symbols bound to query placeholders, in order
+
+	Timeout     model.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`           // query own timeout, within the scrape timeout
+	MinInterval model.Duration `yaml:"min_interval,omitempty" json:"min_interval,omitempty"` // minimum interval between query executions
+	ForEach     *ForEachConfig `yaml:"foreach,omitempty" json:"foreach,omitempty"`           // source query: the query is run for each of its rows
 
-	metrics []*MetricConfig // metrics referencing this query
+	metrics  []*MetricConfig    // metrics referencing this query
+	template *template.Template // Query parsed, if it contains a template
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -815,12 +1532,150 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if q.Query == "" {
 		return fmt.Errorf("missing query literal for query %q", q.Name)
 	}
+	if err := checkQueryParams(q.Params, q.Name); err != nil {
+		return err
+	}
+	if q.Timeout < 0 || q.MinInterval < 0 {
+		return fmt.Errorf("timeout and min_interval can't be negative for query %q", q.Name)
+	}
+	tmpl, err := parseQueryTemplate(q.Name, q.Query)
+	if err != nil {
+		return err
+	}
+	q.template = tmpl
 
 	q.metrics = make([]*MetricConfig, 0, 2)
 
 	return checkOverflow(q.XXX, "metric")
 }
 
+// PerDatabaseConfig defines how the databases of the server are discovered for a collector run in each of them.
+type PerDatabaseConfig struct {
+	Query   string `yaml:"query,omitempty" json:"query,omitempty"`     // query returning database names in first column; default from driver
+	Include string `yaml:"include,omitempty" json:"include,omitempty"` // regex (anchored) of database names to collect
+	Exclude string `yaml:"exclude,omitempty" json:"exclude,omitempty"` // regex (anchored) of database names to skip
+	Label   string `yaml:"label,omitempty" json:"label,omitempty"`     // name of the label added to the metrics; default "database"
+
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for PerDatabaseConfig.
+func (p *PerDatabaseConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PerDatabaseConfig
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	if p.Label == "" {
+		p.Label = "database"
+	}
+	p.Label = strings.ToLower(p.Label)
+	if err := checkLabel(p.Label, "per_database", "label"); err != nil {
+		return err
+	}
+	if !model.LabelName(p.Label).IsValidLegacy() {
+		return fmt.Errorf("invalid label name %q for per_database", p.Label)
+	}
+	var err error
+	if p.Include != "" {
+		if p.include, err = regexp.Compile("^(?:" + p.Include + ")$"); err != nil {
+			return fmt.Errorf("invalid include regex %q for per_database: %s", p.Include, err)
+		}
+	}
+	if p.Exclude != "" {
+		if p.exclude, err = regexp.Compile("^(?:" + p.Exclude + ")$"); err != nil {
+			return fmt.Errorf("invalid exclude regex %q for per_database: %s", p.Exclude, err)
+		}
+	}
+
+	return checkOverflow(p.XXX, "per_database")
+}
+
+// Match returns true if the database must be collected, according to include and exclude regexes.
+func (p *PerDatabaseConfig) Match(database string) bool {
+	if p.include != nil && !p.include.MatchString(database) {
+		return false
+	}
+	return p.exclude == nil || !p.exclude.MatchString(database)
+}
+
+// ForEachConfig defines the source query of a query run for each item (e.g. databases, PDBs, tenants): each row of
+// the source query is available as "item" symbol (.item.<column> in templates, item.<column> in params) and its
+// columns can be used as key labels of the metrics.
+type ForEachConfig struct {
+	Query  string   `yaml:"query" json:"query"`                       // the source query
+	Params []string `yaml:"params,omitempty" json:"params,omitempty"` // symbols bound to source query placeholders, in order
+
+	template *template.Template // Query parsed, if it contains a template
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ForEachConfig.
+func (f *ForEachConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ForEachConfig
+	if err := unmarshal((*plain)(f)); err != nil {
+		return err
+	}
+
+	if f.Query == "" {
+		return fmt.Errorf("missing query literal for foreach")
+	}
+	if err := checkQueryParams(f.Params, "foreach"); err != nil {
+		return err
+	}
+	tmpl, err := parseQueryTemplate("foreach", f.Query)
+	if err != nil {
+		return err
+	}
+	f.template = tmpl
+
+	return checkOverflow(f.XXX, "foreach")
+}
+
+// checkQueryParams checks the symbols bound to query parameters: internal symbols (starting with "__", e.g. the
+// auth key) can't be used.
+func checkQueryParams(params []string, name string) error {
+	for _, param := range params {
+		if param == "" || strings.HasPrefix(param, "__") || strings.Contains(param, ".__") {
+			return fmt.Errorf("invalid param %q for query %q", param, name)
+		}
+	}
+	return nil
+}
+
+// VariablesConfig contains user-defined variables (e.g. schema name, tenant id, thresholds), added to the target
+// symbol table so that they can be used in query templates and params, and in metrics static labels.
+type VariablesConfig map[string]string
+
+// reservedSymbols are the symbols set by the exporter in the target symbol table, that can't be used as variables.
+var reservedSymbols = []string{"user", "password", "params", "driver", "auth_key", "item"}
+
+// variableNameRE matches valid variable names, usable as {{ .name }} in templates.
+var variableNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for VariablesConfig.
+func (v *VariablesConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain VariablesConfig
+	if err := unmarshal((*plain)(v)); err != nil {
+		return err
+	}
+	for name := range *v {
+		if !variableNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+		if slices.Contains(reservedSymbols, name) {
+			return fmt.Errorf("variable name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
 // Secret special type for storing secrets.
 type Secret string
 
@@ -963,5 +1818,20 @@ func ErrorWrap(logContext []interface{}, err error) error {
 	for i := 0; i < len(logCtx); i += 2 {
 		tmp[logCtx[i]] = logCtx[i+1]
 	}
-	return fmt.Errorf("%v", tmp)
+	return &wrappedError{msg: fmt.Sprintf("%v", tmp), err: err}
+}
+
+// wrappedError is an error with log context, keeping the original error for errors.Is() and errors.As() (timeout and
+// login error detection).
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
 }
@@ -0,0 +1,16 @@
+//go:build multi
+
+package main
+
+// multi drivers exporter: the backends are the ones selected by build tags (e.g. -tags multi,mssql,postgres) and the
+// driver is determined for each target by its "driver" parameter or its dsn scheme.
+var (
+	exporter_namespace = "sql"
+)
+
+const (
+	metricsPublishingPort = ":9237"
+	exporter_name         = "sql_exporter"
+	configEnvName         = "SQL_EXPORTER_CONFIG"
+	driver_name           = ""
+)
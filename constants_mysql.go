@@ -0,0 +1,14 @@
+//go:build !db2 && !hana && !mssql && !oracle && !postgres && mysql && !multi
+
+package main
+
+var (
+	exporter_namespace = "mysql"
+)
+
+const (
+	metricsPublishingPort = ":9104"
+	exporter_name         = "mysql_exporter"
+	configEnvName         = "MYSQL_CONFIG"
+	driver_name           = "mysql"
+)
@@ -1,4 +1,4 @@
-//go:build !db2 && !hana && !mssql && !oracle && postgres
+//go:build !db2 && !hana && !mssql && !oracle && postgres && !multi
 
 package main
 
@@ -10,4 +10,5 @@ const (
 	metricsPublishingPort = ":9161"
 	exporter_name         = "postgres_exporter"
 	configEnvName         = "PG_CONFIG"
+	driver_name           = "postgres"
 )
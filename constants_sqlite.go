@@ -0,0 +1,14 @@
+//go:build !db2 && !hana && !mssql && !oracle && !postgres && !mysql && sqlite && !multi
+
+package main
+
+var (
+	exporter_namespace = "sqlite"
+)
+
+const (
+	metricsPublishingPort = ":9430"
+	exporter_name         = "sqlite_exporter"
+	configEnvName         = "SQLITE_CONFIG"
+	driver_name           = "sqlite"
+)
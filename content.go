@@ -76,6 +76,50 @@ const (
       <pre>{{ .Targets }}</pre>
     {{- end }}
 
+	{{ define "content.target_status" -}}
+	<h2>Target {{ .TargetStatus.Name }}</h2>
+	<table>
+		<thead>
+			<tr>
+				<th>Collector</th>
+				<th>Query</th>
+				<th>Status</th>
+				<th>Consecutive failures</th>
+				<th>Last error time</th>
+				<th>Last error</th>
+			</tr>
+		</thead>
+	  	<tbody>
+			<tr class="odd" >
+				<td colspan="2">connection</td>
+				<td>{{ .TargetStatus.StatusText }}</td>
+				<td>{{ .TargetStatus.ConsecutiveFailures }}</td>
+				<td>{{ with .TargetStatus.LastErrorTime }}{{ . }}{{ end }}</td>
+				<td>{{ with .TargetStatus.LastError }}<pre>{{ . }}</pre>{{ end }}</td>
+			</tr>
+			{{- range .TargetStatus.Collectors }}
+			<tr class="odd" >
+				<td colspan="2">{{ .Name }}</td>
+				<td>{{ .StatusText }}</td>
+				<td>{{ .ConsecutiveFailures }}</td>
+				<td>{{ with .LastErrorTime }}{{ . }}{{ end }}</td>
+				<td>{{ with .LastError }}<pre>{{ . }}</pre>{{ end }}</td>
+			</tr>
+			{{- range .Queries }}
+			<tr>
+				<td></td>
+				<td>{{ .Name }}</td>
+				<td>{{ .StatusText }}</td>
+				<td>{{ .ConsecutiveFailures }}</td>
+				<td>{{ with .LastErrorTime }}{{ . }}{{ end }}</td>
+				<td>{{ with .LastError }}<pre>{{ . }}</pre>{{ end }}</td>
+			</tr>
+			{{- end }}
+			{{- end }}
+		</tbody>
+	</table>
+  {{- end }}
+
 	{{ define "content.status" -}}
 	<h2>Build Information</h2>
 	<table>
@@ -144,6 +188,9 @@ type tdata struct {
 	// `/targets` only
 	Targets string
 
+	// `/targets/<name>/status` only
+	TargetStatus *TargetStatus
+
 	// status
 	Version versionInfo
 
@@ -155,13 +202,14 @@ type tdata struct {
 }
 
 var (
-	allTemplates    = template.Must(template.New("").Parse(templates))
-	healthTemplate  = pageTemplate("health")
-	homeTemplate    = pageTemplate("home")
-	configTemplate  = pageTemplate("config")
-	targetsTemplate = pageTemplate("targets")
-	statusTemplate  = pageTemplate("status")
-	errorTemplate   = pageTemplate("error")
+	allTemplates         = template.Must(template.New("").Parse(templates))
+	healthTemplate       = pageTemplate("health")
+	homeTemplate         = pageTemplate("home")
+	configTemplate       = pageTemplate("config")
+	targetsTemplate      = pageTemplate("targets")
+	targetStatusTemplate = pageTemplate("target_status")
+	statusTemplate       = pageTemplate("status")
+	errorTemplate        = pageTemplate("error")
 )
 
 func pageTemplate(name string) *template.Template {
@@ -438,6 +486,48 @@ func TargetsHandlerFunc(metricsPath string, exporter Exporter) func(http.Respons
 	}
 }
 
+// TargetStatusHandlerFunc is the HTTP handler for the `/targets/<name>/status` page. It outputs the last error, its time
+// and the consecutive failures of the target connection, of its collectors and of their queries.
+func TargetStatusHandlerFunc(metricsPath string, exporter Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		ctxval, ok := r.Context().Value(ctxKey{}).(*ctxValue)
+		if !ok {
+			err := errors.New("invalid context received")
+			HandleError(http.StatusInternalServerError, err, metricsPath, exporter, w, r)
+			return
+
+		}
+		tg, err := exporter.FindTarget(ctxval.path)
+		if err != nil {
+			HandleError(http.StatusNotFound, errors.New(`target not found`), metricsPath, exporter, w, r)
+			return
+		}
+		status := tg.TargetStatus()
+
+		accept_type := r.Header.Get(acceptHeader)
+		if strings.Contains(accept_type, applicationJSON) {
+			res, err := json.Marshal(status)
+			if err != nil {
+				HandleError(0, err, metricsPath, exporter, w, r)
+				return
+			}
+			w.Header().Set(contentTypeHeader, applicationJSON)
+			w.Header().Set(contentLengthHeader, fmt.Sprint(len(res)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(res)
+		} else {
+			w.Header().Set(contentTypeHeader, textHTML)
+			targetStatusTemplate.Execute(w, &tdata{
+				ExporterName: exporter.Config().Globals.ExporterName,
+				MetricsPath:  metricsPath,
+				DocsUrl:      docsUrl,
+				TargetStatus: status,
+			})
+		}
+	}
+}
+
 // HandleError is an error handler that other handlers defer to in case of error. It is important to not have written
 // anything to w before calling HandleError(), or the 500 status code won't be set (and the content might be mixed up).
 func HandleError(status int, err error, metricsPath string, exporter Exporter, w http.ResponseWriter, r *http.Request) {
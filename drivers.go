@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// SqlDriver describes a database backend compiled in the exporter: the database/sql driver name used to open the
+// connections, the names (DSN schemes or target "driver" values) it answers to, the function that builds the final dsn
+// passed to the driver and the one that detects login errors so that the connection is reset.
+//
+// Backends supporting per_database collectors set the query listing the databases, and either the statements to switch
+// a pinned connection to a database (CurrentDatabase and UseDatabase), or the function building the dsn of a connection
+// to a database from the target dsn parameters (DatabaseDSN).
+type SqlDriver struct {
+	Name            string
+	Aliases         []string
+	BuildConnection func(logger *slog.Logger, dsn string, auth AuthConfig, symbol_table map[string]any, check_only bool) (string, error)
+	CheckLoginError func(err error) bool
+
+	ListDatabases   string
+	CurrentDatabase string
+	UseDatabase     func(database string) string
+	DatabaseDSN     func(params map[string]string, database string) string
+}
+
+// sqlDrivers contains all the backends compiled in, indexed by name and aliases.
+var sqlDrivers = make(map[string]*SqlDriver)
+
+// RegisterSqlDriver adds a backend to the list of available drivers; it is called by init() of each sql_<backend>.go
+// file, so that the backends available are the ones selected by build tags.
+func RegisterSqlDriver(d *SqlDriver) {
+	sqlDrivers[d.Name] = d
+	for _, alias := range d.Aliases {
+		sqlDrivers[strings.ToLower(alias)] = d
+	}
+}
+
+// SqlDriverNames returns the sorted list of names and aliases of the backends compiled in.
+func SqlDriverNames() []string {
+	names := make([]string, 0, len(sqlDrivers))
+	for name := range sqlDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FindSqlDriver returns the backend to use for a target:
+//
+// * the one set by name in the target config ("driver" parameter),
+//
+// * else the one matching the dsn scheme (e.g. "postgres://..."),
+//
+// * else the default driver of the exporter (driver_name), or the only one compiled in.
+func FindSqlDriver(name string, dsn string) (*SqlDriver, error) {
+	if name != "" {
+		if d, ok := sqlDrivers[strings.ToLower(name)]; ok {
+			return d, nil
+		}
+		return nil, fmt.Errorf("driver '%s' not supported (available: %s)", name, strings.Join(SqlDriverNames(), ", "))
+	}
+
+	if idx := strings.Index(dsn, "://"); idx != -1 {
+		scheme := strings.ToLower(dsn[:idx])
+		if d, ok := sqlDrivers[scheme]; ok {
+			return d, nil
+		}
+		return nil, fmt.Errorf("driver '%s' not supported (available: %s)", scheme, strings.Join(SqlDriverNames(), ", "))
+	}
+
+	if d, ok := sqlDrivers[driver_name]; ok {
+		return d, nil
+	}
+	var found *SqlDriver
+	for _, d := range sqlDrivers {
+		if found != nil && found != d {
+			return nil, fmt.Errorf("unable to determine driver from dsn: set 'driver' in target config or use a '<driver>://' dsn (available: %s)",
+				strings.Join(SqlDriverNames(), ", "))
+		}
+		found = d
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no sql driver compiled in exporter")
+	}
+	return found, nil
+}
@@ -44,6 +44,8 @@ type Exporter interface {
 	IncreaseLogLevel(string)
 
 	ReloadConfig() error
+	// StartScheduler starts the background collection of targets in scheduler mode.
+	StartScheduler()
 }
 
 type exporter struct {
@@ -58,6 +60,10 @@ type exporter struct {
 	logLevel      string
 	health_only   bool
 	content_mutex *sync.Mutex
+
+	// background collection of targets in scheduler mode: stopped on reload
+	scheduler_cancel context.CancelFunc
+	scheduler_wg     *sync.WaitGroup
 }
 
 // NewExporter returns a new Exporter with the provided config.
@@ -73,6 +79,10 @@ func NewExporter(configFile string, logger *slog.Logger, collectorName string) (
 			return nil, fmt.Errorf("the config.data-source-name flag (value %q) only applies in single target mode", *dsnOverride)
 		} else {
 			c.Targets[0].DSN = Secret(*dsnOverride)
+			c.Targets[0].driver = nil
+			if _, err := c.Targets[0].SqlDriver(); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -164,6 +174,10 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 				dtoMetricFamily.Type = dto.MetricType_GAUGE.Enum()
 			case dtoMetric.Counter != nil:
 				dtoMetricFamily.Type = dto.MetricType_COUNTER.Enum()
+			case dtoMetric.Histogram != nil:
+				dtoMetricFamily.Type = dto.MetricType_HISTOGRAM.Enum()
+			case dtoMetric.Summary != nil:
+				dtoMetricFamily.Type = dto.MetricType_SUMMARY.Enum()
 			default:
 				errs = append(errs, fmt.Errorf("don't know how to handle metric %v", dtoMetric))
 				continue
@@ -373,12 +387,51 @@ func (e *exporter) ReloadConfig() error {
 	e.content_mutex.Lock()
 	e.config = c
 	old_targets := e.targets
+	restart := e.scheduler_cancel != nil
+	e.stopScheduler()
 	for _, t := range old_targets {
 		t.CloseCnx()
+		deleteQueryStats(t.Config())
 	}
 	e.targets = targets
 	e.SetReloadTime(time.Now())
 	e.content_mutex.Unlock()
 
+	if restart {
+		e.StartScheduler()
+	}
 	return nil
 }
+
+// StartScheduler implements Exporter.StartScheduler: each target in scheduler mode is collected in background until
+// the configuration is reloaded.
+func (e *exporter) StartScheduler() {
+	e.content_mutex.Lock()
+	defer e.content_mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	for _, t := range e.targets {
+		if !t.Scheduled() {
+			continue
+		}
+		wg.Add(1)
+		go func(target Target) {
+			defer wg.Done()
+			target.RunScheduler(ctx)
+		}(t)
+	}
+	e.scheduler_cancel = cancel
+	e.scheduler_wg = wg
+}
+
+// stopScheduler stops the background collection of targets and waits for the collectors runs to end.
+func (e *exporter) stopScheduler() {
+	if e.scheduler_cancel == nil {
+		return
+	}
+	e.scheduler_cancel()
+	e.scheduler_wg.Wait()
+	e.scheduler_cancel = nil
+	e.scheduler_wg = nil
+}
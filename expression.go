@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// valueExpression is an arithmetic expression compiled from a metric transform: it computes the sample value from the
+// value read in the column, named "value" in the expression.
+type valueExpression func(value float64) float64
+
+// expressionParser is a simple recursive descent parser for arithmetic expressions on "value":
+//
+//	expr   := term { ("+" | "-") term }
+//	term   := factor { ("*" | "/") factor }
+//	factor := ("+" | "-") factor | number | "value" | "(" expr ")"
+type expressionParser struct {
+	input string
+	pos   int
+}
+
+// compileExpression parses the expression and returns the function computing it.
+func compileExpression(expr string) (valueExpression, error) {
+	p := &expressionParser{input: expr}
+	f, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", expr, err)
+	}
+	if p.skipSpaces(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("invalid expression %q: unexpected %q at position %d", expr, p.input[p.pos:], p.pos)
+	}
+	return f, nil
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// next returns the next non space character without consuming it, 0 at end of input.
+func (p *expressionParser) next() byte {
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *expressionParser) expr() (valueExpression, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.next()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(v float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v float64) float64 { return l(v) - right(v) }
+		}
+	}
+}
+
+func (p *expressionParser) term() (valueExpression, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.next()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '*' {
+			left = func(v float64) float64 { return l(v) * right(v) }
+		} else {
+			left = func(v float64) float64 { return l(v) / right(v) }
+		}
+	}
+}
+
+func (p *expressionParser) factor() (valueExpression, error) {
+	switch c := p.next(); {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '+' || c == '-':
+		p.pos++
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		if c == '-' {
+			return func(v float64) float64 { return -f(v) }, nil
+		}
+		return f, nil
+	case c == '(':
+		p.pos++
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return f, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE", p.input[p.pos]) != -1 {
+			// exponent sign
+			if (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') && p.pos+1 < len(p.input) &&
+				(p.input[p.pos+1] == '+' || p.input[p.pos+1] == '-') {
+				p.pos++
+			}
+			p.pos++
+		}
+		num, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", p.input[start:p.pos], start)
+		}
+		return func(float64) float64 { return num }, nil
+	default:
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		if name := p.input[start:p.pos]; name != "value" {
+			if name == "" {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, start)
+			}
+			return nil, fmt.Errorf("unknown variable %q at position %d: only 'value' is allowed", name, start)
+		}
+		return func(v float64) float64 { return v }, nil
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryLimiter limits the number of queries running concurrently on a target. Queries waiting for a slot are queued
+// and granted in a defined order: the order of the collectors in the target, then the order of the queries in the
+// collector.
+type queryLimiter struct {
+	mutex   sync.Mutex
+	free    int
+	waiters []*limiterWaiter
+}
+
+// limiterWaiter is a query waiting for a slot; ready is closed when the slot is granted.
+type limiterWaiter struct {
+	order queryOrder
+	ready chan struct{}
+}
+
+// queryOrder is the rank of a query in the target: collector index, then query index in the collector.
+type queryOrder struct {
+	collector int
+	query     int
+}
+
+func (o queryOrder) less(other queryOrder) bool {
+	return o.collector < other.collector || (o.collector == other.collector && o.query < other.query)
+}
+
+// newQueryLimiter returns a limiter allowing max concurrent queries.
+func newQueryLimiter(max int) *queryLimiter {
+	return &queryLimiter{free: max}
+}
+
+// Acquire waits for a slot, until the context is done; it returns the time spent waiting.
+func (l *queryLimiter) Acquire(ctx context.Context, order queryOrder) (time.Duration, error) {
+	start := time.Now()
+	l.mutex.Lock()
+	if l.free > 0 && len(l.waiters) == 0 {
+		l.free--
+		l.mutex.Unlock()
+		return 0, nil
+	}
+	w := &limiterWaiter{order: order, ready: make(chan struct{})}
+	idx := sort.Search(len(l.waiters), func(i int) bool { return order.less(l.waiters[i].order) })
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[idx+1:], l.waiters[idx:])
+	l.waiters[idx] = w
+	l.mutex.Unlock()
+
+	select {
+	case <-w.ready:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		l.mutex.Lock()
+		for i, waiter := range l.waiters {
+			if waiter == w {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				l.mutex.Unlock()
+				return time.Since(start), ctx.Err()
+			}
+		}
+		l.mutex.Unlock()
+		// slot granted meanwhile: give it back
+		l.Release()
+		return time.Since(start), ctx.Err()
+	}
+}
+
+// Release frees a slot, granted to the first query waiting if any.
+func (l *queryLimiter) Release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.waiters) > 0 {
+		w := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		close(w.ready)
+		return
+	}
+	l.free++
+}
+
+// collectorSlot is passed in the context of a collector run on a target with a query limiter: the collector rank in
+// the target and the total time its queries waited for a slot (in nanoseconds).
+type collectorSlot struct {
+	limiter   *queryLimiter
+	collector int
+	waited    atomic.Int64
+}
+
+type collectorSlotKey struct{}
+
+// withCollectorSlot returns a context carrying the limiter of the target for the collector.
+func withCollectorSlot(ctx context.Context, slot *collectorSlot) context.Context {
+	return context.WithValue(ctx, collectorSlotKey{}, slot)
+}
+
+// acquireQuerySlot waits for a slot of the target limiter, if any, and returns the function releasing it.
+func acquireQuerySlot(ctx context.Context, query int) (func(), error) {
+	slot, ok := ctx.Value(collectorSlotKey{}).(*collectorSlot)
+	if !ok || slot == nil || slot.limiter == nil {
+		return func() {}, nil
+	}
+	waited, err := slot.limiter.Acquire(ctx, queryOrder{collector: slot.collector, query: query})
+	slot.waited.Add(int64(waited))
+	if err != nil {
+		return nil, err
+	}
+	return slot.limiter.Release, nil
+}
+
+// withOwnQuerySlot returns a context with a slot of its own on the limiter of the collector, if any: the queries of a
+// run outliving the scrape (background refresh) still wait for the limiter, but their wait is not added to the scrape
+// one.
+func withOwnQuerySlot(ctx context.Context) context.Context {
+	slot, ok := ctx.Value(collectorSlotKey{}).(*collectorSlot)
+	if !ok || slot == nil {
+		return ctx
+	}
+	return withCollectorSlot(ctx, &collectorSlot{limiter: slot.limiter, collector: slot.collector})
+}
+
+// withoutQuerySlot returns a context in which queries don't wait for a slot, for queries run under a slot already
+// acquired (e.g. on a pinned connection).
+func withoutQuerySlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, collectorSlotKey{}, (*collectorSlot)(nil))
+}
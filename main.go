@@ -87,6 +87,7 @@ func BuildHandler(exporter Exporter, actionCh chan<- actionMsg) http.Handler {
 		newRoute(OpMatch, "/loglevel(?:/(.*))?", LogLevelHandlerFunc(*metricsPath, exporter, actionCh, "")),
 		newRoute(OpEgals, "/reload", ReloadHandlerFunc(*metricsPath, exporter, actionCh)),
 		newRoute(OpEgals, "/status", StatusHandlerFunc(*metricsPath, exporter)),
+		newRoute(OpMatch, "/targets/(.+)/status", TargetStatusHandlerFunc(*metricsPath, exporter)),
 		newRoute(OpMatch, "/targets(?:/(.*))?", TargetsHandlerFunc(*metricsPath, exporter)),
 		newRoute(OpEgals, *metricsPath, func(w http.ResponseWriter, r *http.Request) { ExporterHandlerFor(exporter).ServeHTTP(w, r) }),
 		// Expose exporter metrics separately, for debugging purposes.
@@ -282,6 +283,7 @@ func main() {
 
 	exporter.SetStartTime(time.Now())
 	exporter.SetReloadTime(time.Now())
+	exporter.StartScheduler()
 
 	user2 := make(chan os.Signal, 1)
 	init_sigusr2(user2)
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -31,12 +38,17 @@ type MetricFamily struct {
 	logContext  []interface{}
 }
 
-// NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance).
-func NewMetricFamily(logContext []interface{}, mc *MetricConfig, constLabels []*dto.LabelPair) (*MetricFamily, error) {
+// NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance);
+// static labels values may use the target variables.
+func NewMetricFamily(
+	logContext []interface{},
+	mc *MetricConfig,
+	constLabels []*dto.LabelPair,
+	variables VariablesConfig) (*MetricFamily, error) {
 	logContext = append(logContext, "metric", mc.Name)
 
-	if len(mc.Values) == 0 {
-		logContext = append(logContext, "errmsg", "multiple values but no value label")
+	if len(mc.Values) == 0 && mc.Histogram == nil && !mc.IsInfo() {
+		logContext = append(logContext, "errmsg", "no value defined")
 		return nil, fmt.Errorf("%s", logContext...)
 	}
 	if len(mc.Values) > 1 && mc.ValueLabel == "" {
@@ -53,6 +65,11 @@ func NewMetricFamily(logContext []interface{}, mc *MetricConfig, constLabels []*
 	sortedLabels := append(constLabels[:0:0], constLabels...)
 
 	for k, v := range mc.StaticLabels {
+		v, err := renderLabelTemplate(k, v, variables)
+		if err != nil {
+			logContext = append(logContext, "errmsg", err.Error())
+			return nil, fmt.Errorf("%s", logContext...)
+		}
 		sortedLabels = append(sortedLabels, &dto.LabelPair{
 			Name:  proto.String(k),
 			Value: proto.String(v),
@@ -68,28 +85,127 @@ func NewMetricFamily(logContext []interface{}, mc *MetricConfig, constLabels []*
 	}, nil
 }
 
-// Collect is the equivalent of prometheus.Collector.Collect() but takes a Query output map to populate values from.
-func (mf MetricFamily) Collect(row map[string]interface{}, ch chan<- Metric) {
+// labelValues returns the values of the key labels found in the Query output map, rewritten by the label rules.
+func (mf MetricFamily) labelValues(row map[string]interface{}) []string {
 	labelValues := make([]string, len(mf.labels))
 	for i, label := range mf.config.KeyLabels {
 		if val, ok := row[label]; ok {
 			labelValues[i] = val.(string)
+			if rule, ok := mf.config.LabelRules[label]; ok {
+				labelValues[i] = rule.Apply(labelValues[i])
+			}
 		} else {
 			mf.logContext = append(mf.logContext, "errmsg", fmt.Sprintf("label '%s", label))
 			labelValues[i] = "<not_found>"
 		}
 	}
+	return labelValues
+}
+
+// Collect is the equivalent of prometheus.Collector.Collect() but takes a Query output map to populate values from.
+//
+// Metrics built from several rows (histogram with one row per bucket, aggregated histogram or summary) are added to the
+// accumulator instead, and sent by its Flush() method once all rows are read. It returns the error of the invalid
+// metrics sent, if any.
+func (mf *MetricFamily) Collect(row map[string]interface{}, acc *rowsAccumulator, ch chan<- Metric) error {
+	labelValues := mf.labelValues(row)
+	if mf.config.Aggregate != nil {
+		acc.addObservation(mf, labelValues, row)
+		return nil
+	}
+	if h := mf.config.Histogram; h != nil {
+		if h.BucketLabel != "" {
+			return acc.addHistogramBucket(mf, labelValues, row, ch)
+		}
+		return send(ch, mf.newHistogramFromColumns(labelValues, row))
+	}
+	var ts time.Time
+	if mf.config.TimestampColumn != "" {
+		var keep bool
+		if ts, keep = mf.timestamp(row); !keep {
+			return nil
+		}
+	}
+	if mf.config.IsInfo() {
+		if !acc.addInfo(mf, labelValues) {
+			return send(ch, NewInvalidMetric(mf.logContext,
+				fmt.Errorf("info %s: several rows with labels %q", mf.Name(), labelValues)))
+		}
+		ch <- NewMetricWithTimestamp(mf, 1, labelValues, ts)
+		return nil
+	}
+	if mf.config.IsStateSet() {
+		return mf.collectStates(row, labelValues, ts, ch)
+	}
 	for _, v := range mf.config.Values {
 		if mf.config.ValueLabel != "" {
 			labelValues[len(labelValues)-1] = v
 		}
 		if row[v] != nil {
-			value := row[v].(float64)
-			ch <- NewMetric(&mf, value, labelValues)
+			value := mf.config.transform(v, row[v].(float64))
+			ch <- NewMetricWithTimestamp(mf, value, labelValues, ts)
 		} else {
 			fmt.Println("error !!!!")
 		}
 	}
+	return nil
+}
+
+// send sends the metric and returns its error if it is an invalid metric.
+func send(ch chan<- Metric, metric Metric) error {
+	ch <- metric
+	if m, ok := metric.(invalidMetric); ok {
+		return m.err
+	}
+	return nil
+}
+
+// collectStates sends one sample per state of a stateset metric: 1 for the state read from the value column (compared
+// case-insensitively), 0 for the others. All states are 0 if the column is NULL; an unknown state is reported as an
+// invalid metric, in addition to the samples set to 0, and its error returned.
+func (mf *MetricFamily) collectStates(row map[string]interface{}, labelValues []string, ts time.Time, ch chan<- Metric) error {
+	var err error
+	column := mf.config.Values[0]
+	state, _ := row[column].(sql.NullString)
+	current := -1
+	if state.Valid {
+		value := strings.TrimSpace(state.String)
+		current = slices.IndexFunc(mf.config.States, func(s string) bool {
+			return strings.EqualFold(s, value)
+		})
+		if current == -1 {
+			err = send(ch, NewInvalidMetric(mf.logContext,
+				fmt.Errorf("stateset %s: unknown state %q in column %q", mf.Name(), value, column)))
+		}
+	}
+	for i, s := range mf.config.States {
+		labelValues[len(labelValues)-1] = s
+		value := 0.
+		if i == current {
+			value = 1
+		}
+		ch <- NewMetricWithTimestamp(mf, value, labelValues, ts)
+	}
+	return err
+}
+
+// timestamp returns the sample timestamp read from the timestamp column, converted to the metric location if the
+// column has no time zone, and false if the sample is older than timestamp_max_age. NULL gives a zero time: the
+// sample has no timestamp.
+func (mf *MetricFamily) timestamp(row map[string]interface{}) (time.Time, bool) {
+	rts, _ := row[mf.config.TimestampColumn].(rowTimestamp)
+	ts := rts.time
+	if ts.IsZero() {
+		return ts, true
+	}
+	if loc := mf.config.location; loc != nil && !rts.absolute {
+		// datetime without time zone: keep wall clock in configured location
+		ts = time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), ts.Nanosecond(), loc)
+	}
+	if max_age := time.Duration(mf.config.TimestampMaxAge); max_age > 0 && time.Since(ts) > max_age {
+		return ts, false
+	}
+	return ts, true
 }
 
 // Name implements MetricDesc.
@@ -203,11 +319,20 @@ func NewMetric(desc MetricDesc, value float64, labelValues []string) Metric {
 	}
 }
 
+// NewMetricWithTimestamp returns a metric with one fixed value and the timestamp of the sample; a zero timestamp
+// means no timestamp (time of the scrape).
+func NewMetricWithTimestamp(desc MetricDesc, value float64, labelValues []string, ts time.Time) Metric {
+	m := NewMetric(desc, value, labelValues).(*constMetric)
+	m.ts = ts
+	return m
+}
+
 // constMetric is a metric with one fixed value that cannot be changed.
 type constMetric struct {
 	desc       MetricDesc
 	val        float64
 	labelPairs []*dto.LabelPair
+	ts         time.Time
 }
 
 // Desc implements Metric.
@@ -229,6 +354,9 @@ func (m *constMetric) Write(out *dto.Metric) error {
 		logContext = append(logContext, "errmsg", fmt.Sprintf("encountered unknown type %v", t))
 		return fmt.Errorf("%s", logContext...)
 	}
+	if !m.ts.IsZero() {
+		out.TimestampMs = proto.Int64(m.ts.UnixMilli())
+	}
 	return nil
 }
 
@@ -274,6 +402,379 @@ func (s labelPairSorter) Less(i, j int) bool {
 	return s[i].GetName() < s[j].GetName()
 }
 
+//
+// histogram
+//
+
+// newHistogramFromColumns builds a histogram from a row containing one column per bucket.
+func (mf *MetricFamily) newHistogramFromColumns(labelValues []string, row map[string]interface{}) Metric {
+	h := mf.config.Histogram
+	counts := make([]float64, len(h.columns))
+	for i, col := range h.columns {
+		counts[i], _ = row[col].(float64)
+	}
+	sample := &histogramSample{
+		labelValues: labelValues,
+		bounds:      h.bounds,
+		counts:      counts,
+	}
+	if h.infColumn != "" {
+		sample.infCount, _ = row[h.infColumn].(float64)
+		sample.hasInf = true
+	}
+	sample.setSumCount(h, row)
+	return sample.metric(mf)
+}
+
+// histogramSample holds the values read from the query result for one histogram (one set of label values).
+type histogramSample struct {
+	labelValues []string
+	bounds      []float64 // upper bounds, sorted
+	counts      []float64 // bucket counts, in bounds order
+	infCount    float64
+	hasInf      bool
+	sum         float64
+	count       float64
+	hasCount    bool
+}
+
+// setSumCount sets sum and count of the sample from their columns if defined.
+func (s *histogramSample) setSumCount(h *HistogramConfig, row map[string]interface{}) {
+	if h.Sum != "" {
+		s.sum, _ = row[h.Sum].(float64)
+	}
+	if h.Count != "" {
+		s.count, _ = row[h.Count].(float64)
+		s.hasCount = true
+	}
+}
+
+// metric builds the histogram Metric from the sample: bucket counts are made cumulative if needed, and count defaults
+// to the +Inf bucket count or to the count of the last bucket.
+func (s *histogramSample) metric(mf *MetricFamily) Metric {
+	h := mf.config.Histogram
+	buckets := make(map[float64]uint64, len(s.bounds))
+	var (
+		cumul float64
+		prev  float64
+	)
+	for i, bound := range s.bounds {
+		if !validCount(s.counts[i]) {
+			return NewInvalidMetric(mf.logContext,
+				fmt.Errorf("histogram %s: bucket le=%g count %g is not a non-negative integer", mf.Name(), bound, s.counts[i]))
+		}
+		if h.cumulative {
+			cumul = s.counts[i]
+		} else {
+			cumul += s.counts[i]
+		}
+		if cumul < prev {
+			return NewInvalidMetric(mf.logContext,
+				fmt.Errorf("histogram %s: bucket le=%g count %g lower than previous bucket %g", mf.Name(), bound, cumul, prev))
+		}
+		prev = cumul
+		buckets[bound] = uint64(cumul)
+	}
+	if s.hasInf && !validCount(s.infCount) {
+		return NewInvalidMetric(mf.logContext,
+			fmt.Errorf("histogram %s: bucket le=+Inf count %g is not a non-negative integer", mf.Name(), s.infCount))
+	}
+	if s.hasCount && !validCount(s.count) {
+		return NewInvalidMetric(mf.logContext,
+			fmt.Errorf("histogram %s: count %g is not a non-negative integer", mf.Name(), s.count))
+	}
+	count := cumul
+	if s.hasInf {
+		if h.cumulative {
+			count = s.infCount
+		} else {
+			count += s.infCount
+		}
+	}
+	if s.hasCount {
+		count = s.count
+	}
+	if count < cumul {
+		return NewInvalidMetric(mf.logContext,
+			fmt.Errorf("histogram %s: count %g lower than last bucket count %g", mf.Name(), count, cumul))
+	}
+	return NewHistogramMetric(mf, uint64(count), s.sum, buckets, s.labelValues)
+}
+
+// validCount returns true if the value read for a histogram count is a non-negative integer, that converts to uint64
+// without wrapping or truncation (false for NaN).
+func validCount(value float64) bool {
+	return value >= 0 && value < math.MaxUint64 && value == math.Trunc(value)
+}
+
+// rowsAccumulator gathers, for one execution of a query, the samples of the metrics built from several rows (e.g.
+// histogram with one row per bucket). Samples are sent by Flush() once all rows are read.
+type rowsAccumulator struct {
+	keys    []accumulatorKey
+	samples map[accumulatorKey]accumulatedSample
+	// label values of the info metrics sent
+	infos map[accumulatorKey]struct{}
+}
+
+type accumulatorKey struct {
+	mf     *MetricFamily
+	labels string
+}
+
+// accumulatedSample is a sample built from several rows.
+type accumulatedSample interface {
+	metric(mf *MetricFamily) Metric
+}
+
+// newRowsAccumulator returns an empty accumulator.
+func newRowsAccumulator() *rowsAccumulator {
+	return &rowsAccumulator{
+		samples: make(map[accumulatorKey]accumulatedSample),
+		infos:   make(map[accumulatorKey]struct{}),
+	}
+}
+
+// sample returns the sample matching the metric family and label values, created by newSample if not found.
+func (acc *rowsAccumulator) sample(mf *MetricFamily, labelValues []string, newSample func() accumulatedSample) accumulatedSample {
+	key := accumulatorKey{mf: mf, labels: strings.Join(labelValues, "\xff")}
+	sample, ok := acc.samples[key]
+	if !ok {
+		sample = newSample()
+		acc.samples[key] = sample
+		acc.keys = append(acc.keys, key)
+	}
+	return sample
+}
+
+// addInfo records the label values of an info metric, and returns false if they were already sent by another row: the
+// same series can't be exposed twice.
+func (acc *rowsAccumulator) addInfo(mf *MetricFamily, labelValues []string) bool {
+	key := accumulatorKey{mf: mf, labels: strings.Join(labelValues, "\xff")}
+	if _, ok := acc.infos[key]; ok {
+		return false
+	}
+	acc.infos[key] = struct{}{}
+	return true
+}
+
+// addHistogramBucket adds the bucket read from the row to the histogram sample matching the label values. A row with an
+// invalid upper bound is dropped and reported as an invalid metric, and its error returned.
+func (acc *rowsAccumulator) addHistogramBucket(mf *MetricFamily, labelValues []string, row map[string]interface{}, ch chan<- Metric) error {
+	h := mf.config.Histogram
+	le, _ := row[h.BucketLabel].(string)
+	bound, err := strconv.ParseFloat(strings.TrimSpace(le), 64)
+	if err != nil {
+		var logCtx []interface{}
+		logCtx = append(logCtx, mf.logContext...)
+		logCtx = append(logCtx, "le", le)
+		return send(ch, NewInvalidMetric(logCtx,
+			fmt.Errorf("histogram %s: invalid bucket upper bound %q in column %q", mf.Name(), le, h.BucketLabel)))
+	}
+	sample := acc.sample(mf, labelValues, func() accumulatedSample {
+		return &histogramSample{labelValues: labelValues}
+	}).(*histogramSample)
+
+	value, _ := row[h.BucketValue].(float64)
+	if math.IsInf(bound, +1) {
+		sample.infCount += value
+		sample.hasInf = true
+	} else {
+		idx := sort.SearchFloat64s(sample.bounds, bound)
+		if idx < len(sample.bounds) && sample.bounds[idx] == bound {
+			sample.counts[idx] += value
+		} else {
+			sample.bounds = slices.Insert(sample.bounds, idx, bound)
+			sample.counts = slices.Insert(sample.counts, idx, value)
+		}
+	}
+	sample.setSumCount(h, row)
+	return nil
+}
+
+// addObservation adds the value read from the row to the observations matching the label values.
+func (acc *rowsAccumulator) addObservation(mf *MetricFamily, labelValues []string, row map[string]interface{}) {
+	sample := acc.sample(mf, labelValues, func() accumulatedSample {
+		return &observationsSample{labelValues: labelValues}
+	}).(*observationsSample)
+
+	value, ok := row[mf.config.Values[0]].(float64)
+	if !ok || math.IsNaN(value) {
+		return
+	}
+	sample.values = append(sample.values, mf.config.transform(mf.config.Values[0], value))
+}
+
+// Flush sends the metrics accumulated, in the order of the rows, and returns the errors of those that are invalid.
+func (acc *rowsAccumulator) Flush(ch chan<- Metric) error {
+	var errs []error
+	for _, key := range acc.keys {
+		if err := send(ch, acc.samples[key].metric(key.mf)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	acc.keys = acc.keys[:0]
+	clear(acc.samples)
+	clear(acc.infos)
+	return errors.Join(errs...)
+}
+
+// observationsSample holds the values of the rows folded by the exporter into one histogram or summary.
+type observationsSample struct {
+	labelValues []string
+	values      []float64
+}
+
+// metric builds the histogram or the summary Metric from the observations.
+func (s *observationsSample) metric(mf *MetricFamily) Metric {
+	a := mf.config.Aggregate
+	var sum float64
+	for _, v := range s.values {
+		sum += v
+	}
+	count := uint64(len(s.values))
+
+	if a.summary {
+		quantiles := make(map[float64]float64, len(a.Quantiles))
+		if len(s.values) > 0 {
+			sorted := slices.Clone(s.values)
+			sort.Float64s(sorted)
+			for _, q := range a.Quantiles {
+				quantiles[q] = quantile(sorted, q)
+			}
+		} else {
+			for _, q := range a.Quantiles {
+				quantiles[q] = math.NaN()
+			}
+		}
+		return NewSummaryMetric(mf, count, sum, quantiles, s.labelValues)
+	}
+
+	bounds := a.Buckets
+	if len(bounds) == 0 {
+		bounds = prometheus.DefBuckets
+	}
+	buckets := make(map[float64]uint64, len(bounds))
+	for _, bound := range bounds {
+		buckets[bound] = 0
+	}
+	for _, v := range s.values {
+		// first bucket with upper bound >= v
+		for i := sort.SearchFloat64s(bounds, v); i < len(bounds); i++ {
+			buckets[bounds[i]]++
+		}
+	}
+	return NewHistogramMetric(mf, count, sum, buckets, s.labelValues)
+}
+
+// quantile returns the q-quantile of sorted values, linearly interpolated between closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// NewHistogramMetric returns a histogram metric with fixed count, sum and buckets (upper bound => cumulative count).
+//
+// NewHistogramMetric panics if the length of labelValues is not consistent with desc.labels().
+func NewHistogramMetric(desc MetricDesc, count uint64, sum float64, buckets map[float64]uint64, labelValues []string) Metric {
+	if len(desc.Labels()) != len(labelValues) {
+		panic(fmt.Sprintf("[%s] expected %d labels, got %d", desc.LogContext(), len(desc.Labels()), len(labelValues)))
+	}
+	return &histogramMetric{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		buckets:    buckets,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// histogramMetric is a histogram with fixed values.
+type histogramMetric struct {
+	desc       MetricDesc
+	count      uint64
+	sum        float64
+	buckets    map[float64]uint64
+	labelPairs []*dto.LabelPair
+}
+
+// Desc implements Metric.
+func (m *histogramMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *histogramMetric) Write(out *dto.Metric) error {
+	out.Label = m.labelPairs
+	buckets := make([]*dto.Bucket, 0, len(m.buckets))
+	for bound, count := range m.buckets {
+		buckets = append(buckets, &dto.Bucket{
+			CumulativeCount: proto.Uint64(count),
+			UpperBound:      proto.Float64(bound),
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+	out.Histogram = &dto.Histogram{
+		SampleCount: proto.Uint64(m.count),
+		SampleSum:   proto.Float64(m.sum),
+		Bucket:      buckets,
+	}
+	return nil
+}
+
+// NewSummaryMetric returns a summary metric with fixed count, sum and quantiles (quantile => value).
+//
+// NewSummaryMetric panics if the length of labelValues is not consistent with desc.labels().
+func NewSummaryMetric(desc MetricDesc, count uint64, sum float64, quantiles map[float64]float64, labelValues []string) Metric {
+	if len(desc.Labels()) != len(labelValues) {
+		panic(fmt.Sprintf("[%s] expected %d labels, got %d", desc.LogContext(), len(desc.Labels()), len(labelValues)))
+	}
+	return &summaryMetric{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		quantiles:  quantiles,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// summaryMetric is a summary with fixed values.
+type summaryMetric struct {
+	desc       MetricDesc
+	count      uint64
+	sum        float64
+	quantiles  map[float64]float64
+	labelPairs []*dto.LabelPair
+}
+
+// Desc implements Metric.
+func (m *summaryMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *summaryMetric) Write(out *dto.Metric) error {
+	out.Label = m.labelPairs
+	quantiles := make([]*dto.Quantile, 0, len(m.quantiles))
+	for q, value := range m.quantiles {
+		quantiles = append(quantiles, &dto.Quantile{
+			Quantile: proto.Float64(q),
+			Value:    proto.Float64(value),
+		})
+	}
+	sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].GetQuantile() < quantiles[j].GetQuantile() })
+	out.Summary = &dto.Summary{
+		SampleCount: proto.Uint64(m.count),
+		SampleSum:   proto.Float64(m.sum),
+		Quantile:    quantiles,
+	}
+	return nil
+}
+
 type invalidMetric struct {
 	logContext []interface{}
 	err        error
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// collectPerDatabase discovers the databases of the server and runs the queries of the collector in each of them,
+// with the database name added as label; it returns the status of the executions in all the databases.
+func (c *collector) collectPerDatabase(
+	ctx context.Context,
+	conn *sql.DB,
+	symbols_table map[string]interface{},
+	ch chan<- Metric) int {
+	sql_driver := sqlDrivers[GetMapValueString(symbols_table, "driver")]
+	if sql_driver == nil || (sql_driver.UseDatabase == nil && sql_driver.DatabaseDSN == nil) {
+		ch <- NewInvalidMetric(c.logContext, fmt.Errorf("per_database collector not supported by driver"))
+		return CollectorStatusError
+	}
+
+	databases, err := c.listDatabases(ctx, conn, sql_driver)
+	if err != nil {
+		ch <- NewInvalidMetric(c.logContext, err)
+		return errorStatus(ctx, err, sql_driver)
+	}
+	if sql_driver.DatabaseDSN != nil {
+		c.releaseDatabaseConns(conn, databases)
+	}
+
+	statuses := make([]int, 0, len(databases))
+	for _, database := range databases {
+		if ctx.Err() != nil {
+			ch <- NewInvalidMetric(c.logContext, ctx.Err())
+			statuses = append(statuses, errorStatus(ctx, ctx.Err(), sql_driver))
+			break
+		}
+		labels := map[string]string{c.config.PerDatabase.Label: database}
+		var db_status int
+		var logContext []interface{}
+		logContext = append(logContext, c.logContext...)
+		logContext = append(logContext, "database", database)
+		if sql_driver.UseDatabase != nil {
+			db_status = c.collectPinnedDatabase(ctx, logContext, conn, sql_driver, database, symbols_table, labels, ch)
+		} else {
+			pool, err := c.databaseConn(ctx, logContext, sql_driver, database, symbols_table)
+			if err != nil {
+				ch <- NewInvalidMetric(logContext, err)
+				statuses = append(statuses, errorStatus(ctx, err, sql_driver))
+				continue
+			}
+			db_status = c.collectQueries(ctx, pool.db, symbols_table, labels, ch)
+			c.releaseDatabaseConn(pool)
+		}
+		statuses = append(statuses, db_status)
+	}
+	return mergeStatus(statuses...)
+}
+
+// listDatabases runs the per_database query (or the driver default one) and returns the names matching the include
+// and exclude regexes.
+func (c *collector) listDatabases(ctx context.Context, conn *sql.DB, sql_driver *SqlDriver) ([]string, error) {
+	query := c.config.PerDatabase.Query
+	if query == "" {
+		query = sql_driver.ListDatabases
+	}
+	var logCtxt []interface{}
+	logCtxt = append(logCtxt, c.logContext...)
+	logCtxt = append(logCtxt, "msg", "per_database query failed")
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, ErrorWrap(logCtxt, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, ErrorWrap(c.logContext, err)
+	}
+	// database name is the first column
+	dest := make([]interface{}, len(columns))
+	for i := range dest {
+		dest[i] = new(interface{})
+	}
+	var name sql.NullString
+	dest[0] = &name
+
+	databases := make([]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, ErrorWrap(logCtxt, err)
+		}
+		if name.Valid && c.config.PerDatabase.Match(name.String) {
+			databases = append(databases, name.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, ErrorWrap(c.logContext, err)
+	}
+	return databases, nil
+}
+
+// collectPinnedDatabase runs the queries on a connection switched to the database; the connection is switched back to
+// its initial database before being released to the pool, or discarded if it can't be.
+func (c *collector) collectPinnedDatabase(
+	ctx context.Context,
+	logContext []interface{},
+	conn *sql.DB,
+	sql_driver *SqlDriver,
+	database string,
+	symbols_table map[string]interface{},
+	labels map[string]string,
+	ch chan<- Metric) int {
+	// the pinned connection holds a single slot of the target query limit for all the queries: waiting for a slot
+	// while holding a connection of the pool could block the queries holding the other slots.
+	release, err := acquireQuerySlot(ctx, 0)
+	if err != nil {
+		ch <- NewInvalidMetric(logContext, err)
+		return errorStatus(ctx, err, sql_driver)
+	}
+	defer release()
+	ctx = withoutQuerySlot(ctx)
+
+	pinned, err := conn.Conn(ctx)
+	if err != nil {
+		ch <- NewInvalidMetric(logContext, err)
+		return errorStatus(ctx, err, sql_driver)
+	}
+	defer pinned.Close()
+
+	var initial sql.NullString
+	if err := pinned.QueryRowContext(ctx, sql_driver.CurrentDatabase).Scan(&initial); err != nil {
+		ch <- NewInvalidMetric(logContext, err)
+		return errorStatus(ctx, err, sql_driver)
+	}
+	if _, err := pinned.ExecContext(ctx, sql_driver.UseDatabase(database)); err != nil {
+		ch <- NewInvalidMetric(logContext, err)
+		return errorStatus(ctx, err, sql_driver)
+	}
+	defer func() {
+		if !initial.Valid {
+			discardConn(pinned)
+		} else if _, err := pinned.ExecContext(context.Background(), sql_driver.UseDatabase(initial.String)); err != nil {
+			discardConn(pinned)
+		}
+	}()
+
+	return c.collectQueries(ctx, pinned, symbols_table, labels, ch)
+}
+
+// discardConn marks the connection as bad, so that it is closed instead of being returned to the pool.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+}
+
+// databasePool is the connection to a database of the target, with the number of runs using it: a connection
+// released while runs (scheduler, concurrent scrapes) use it is closed by the last one.
+type databasePool struct {
+	db       *sql.DB
+	users    int
+	released bool
+}
+
+// databaseConn returns the connection to the database, opened on first use with the target dsn parameters, to be
+// given back by releaseDatabaseConn() once the queries are done. Each database has a single connection, so that the
+// databases don't multiply the maximum connections of the target.
+func (c *collector) databaseConn(
+	ctx context.Context,
+	logContext []interface{},
+	sql_driver *SqlDriver,
+	database string,
+	symbols_table map[string]interface{}) (*databasePool, error) {
+	c.dbConnsMutex.Lock()
+	defer c.dbConnsMutex.Unlock()
+
+	if pool, ok := c.dbConns[database]; ok {
+		pool.users++
+		return pool, nil
+	}
+	params, ok := symbols_table["params"].(map[string]string)
+	if !ok {
+		return nil, fmt.Errorf("no connection parameters for target")
+	}
+	db_conn, err := OpenConnection(ctx, logContext, c.logger,
+		sql_driver.Name, sql_driver.DatabaseDSN(params, database), 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	if c.dbConns == nil {
+		c.dbConns = make(map[string]*databasePool)
+	}
+	pool := &databasePool{db: db_conn, users: 1}
+	c.dbConns[database] = pool
+	return pool, nil
+}
+
+// releaseDatabaseConn gives back the connection to the database once the queries of a run are done, and closes it if
+// it was released meanwhile.
+func (c *collector) releaseDatabaseConn(pool *databasePool) {
+	c.dbConnsMutex.Lock()
+	defer c.dbConnsMutex.Unlock()
+	pool.users--
+	if pool.released && pool.users == 0 {
+		c.closeDatabasePool(pool)
+	}
+}
+
+// closeDatabasePool closes the connection to the database and the statements of the queries prepared on it. Called
+// with dbConnsMutex.
+func (c *collector) closeDatabasePool(pool *databasePool) {
+	for _, q := range c.queries {
+		q.closeStmts(pool.db)
+	}
+	pool.db.Close()
+}
+
+// releaseDatabaseConns closes the connections to the databases no longer collected, or all of them when the target
+// connection has changed (e.g. new credentials); connections still used by a run are closed at the end of the run.
+func (c *collector) releaseDatabaseConns(conn *sql.DB, databases []string) {
+	c.dbConnsMutex.Lock()
+	defer c.dbConnsMutex.Unlock()
+
+	keep := make(map[string]bool, len(databases))
+	if conn == c.baseConn {
+		for _, database := range databases {
+			keep[database] = true
+		}
+	}
+	for database, pool := range c.dbConns {
+		if !keep[database] {
+			pool.released = true
+			if pool.users == 0 {
+				c.closeDatabasePool(pool)
+			}
+			delete(c.dbConns, database)
+		}
+	}
+	c.baseConn = conn
+}
+
+// databaseConnsCloser is implemented by collectors holding connections of their own to the databases of the target,
+// and statements prepared on the connections.
+type databaseConnsCloser interface {
+	// CloseDatabaseConns closes the connections to the databases and the statements, reopened or prepared again on
+	// next collect if needed.
+	CloseDatabaseConns()
+	// CloseStatements closes the statements prepared on the connection (e.g. target connection replaced).
+	CloseStatements(conn *sql.DB)
+}
+
+// CloseDatabaseConns implements databaseConnsCloser.
+func (c *collector) CloseDatabaseConns() {
+	c.releaseDatabaseConns(nil, nil)
+	for _, q := range c.queries {
+		q.closeStmts(nil)
+	}
+}
+
+// CloseStatements implements databaseConnsCloser.
+func (c *collector) CloseStatements(conn *sql.DB) {
+	for _, q := range c.queries {
+		q.closeStmts(conn)
+	}
+}
+
+// CloseStatements implements databaseConnsCloser.
+func (cc *cachingCollector) CloseStatements(conn *sql.DB) {
+	cc.rawColl.CloseStatements(conn)
+}
+
+// CloseDatabaseConns implements databaseConnsCloser.
+func (cc *cachingCollector) CloseDatabaseConns() {
+	cc.rawColl.CloseDatabaseConns()
+}
+
+// closeDatabaseConns closes the connections to the databases held by the collectors, and their statements.
+func closeDatabaseConns(colls []Collector) {
+	for _, c := range colls {
+		if closer, ok := c.(databaseConnsCloser); ok {
+			closer.CloseDatabaseConns()
+		}
+	}
+}
+
+// closeStatements closes the statements of the collectors prepared on the connection.
+func closeStatements(colls []Collector, conn *sql.DB) {
+	for _, c := range colls {
+		if closer, ok := c.(databaseConnsCloser); ok {
+			closer.CloseStatements(conn)
+		}
+	}
+}
@@ -101,8 +101,9 @@ func ExporterHandlerFor(exporter Exporter) http.Handler {
 		}
 
 		// set authentication for target if one is specified and it differs from target internal
+		// targets collected in background keep their own authentication.
 		auth_name := params.Get("auth_name")
-		if auth_name != "" && target.Config().AuthName != auth_name {
+		if auth_name != "" && target.Config().AuthName != auth_name && !target.Scheduled() {
 			auth := exporter.Config().FindAuthConfig(auth_name)
 			if auth != nil {
 				exporter.Config().logger.Debug(fmt.Sprintf("change authentication to %s", auth_name),
@@ -118,7 +119,11 @@ func ExporterHandlerFor(exporter Exporter) http.Handler {
 		}
 
 		auth_key := params.Get("auth_key")
-		if auth_key != "" {
+		if target.Scheduled() {
+			if auth_key != "" {
+				exporter.Logger().Debug("auth_key ignored for target collected in background", "target", target.Name())
+			}
+		} else if auth_key != "" {
 			target.SetSymbol("auth_key", auth_key)
 		} else {
 			target.DeleteSymbol("auth_key")
@@ -5,11 +5,14 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"html/template"
 	"log/slog"
+	"maps"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -23,16 +26,36 @@ type Query struct {
 	logContext  []interface{}
 	logger      *slog.Logger
 
-	conn *sql.DB
-	stmt *sql.Stmt
+	// statement prepared on each database handle: the target connection, or the connection to each database of a
+	// per_database collector.
+	stmtsMutex sync.Mutex
+	stmts      map[*sql.DB]*sql.Stmt
+
+	// query own timeout and cache, if set in config
+	timeout     time.Duration
+	minInterval time.Duration
+	// Used as a non=blocking semaphore protecting the cache. The value in the channel is the time of the cached metrics.
+	cacheSem chan time.Time
+	// Metrics saved from the last Collect() call, with the status and error of their execution.
+	cache       []Metric
+	cacheStatus int
+	cacheErr    error
+	// status, last error and consecutive failures, for the target status page
+	lastError errorState
+	// rank of the query in the collector, for the query limit of the target
+	order int
+	// self-metrics of the query, nil if not recorded
+	stats *queryStats
 }
 
 type columnType int
 type columnTypeMap map[string]columnType
 
 const (
-	columnTypeKey   = 1
-	columnTypeValue = 2
+	columnTypeKey       = 1
+	columnTypeValue     = 2
+	columnTypeTimestamp = 3
+	columnTypeState     = 4
 )
 
 type fieldType int
@@ -88,12 +111,33 @@ func NewQuery(
 				return nil, err
 			}
 		}
+		var vtype columnType = columnTypeValue
+		if mf.config.IsStateSet() {
+			vtype = columnTypeState
+		}
 		for _, vcol := range mf.config.Values {
 			vcol = strings.ToLower(vcol)
-			if err := setColumnType(logContext, vcol, columnTypeValue, columnTypes); err != nil {
+			if err := setColumnType(logContext, vcol, vtype, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+		if tcol := mf.config.TimestampColumn; tcol != "" {
+			if err := setColumnType(logContext, tcol, columnTypeTimestamp, columnTypes); err != nil {
 				return nil, err
 			}
 		}
+		if h := mf.config.Histogram; h != nil {
+			if h.BucketLabel != "" {
+				if err := setColumnType(logContext, h.BucketLabel, columnTypeKey, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+			for _, vcol := range h.ValueColumns() {
+				if err := setColumnType(logContext, vcol, columnTypeValue, columnTypes); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
 	q := Query{
@@ -103,6 +147,12 @@ func NewQuery(
 		fieldTypes:     fieldTypes,
 		logContext:     logContext,
 		logger:         logger,
+		timeout:        time.Duration(qc.Timeout),
+		minInterval:    time.Duration(qc.MinInterval),
+	}
+	if q.minInterval > 0 {
+		q.cacheSem = make(chan time.Time, 1)
+		q.cacheSem <- time.Time{}
 	}
 	return &q, nil
 }
@@ -112,7 +162,7 @@ func setColumnType(logContext []interface{}, columnName string, ctype columnType
 	previousType, found := columnTypes[columnName]
 	if found {
 		if previousType != ctype {
-			logContext = append(logContext, "errmsg", fmt.Sprintf("column %q used both as key and value", columnName))
+			logContext = append(logContext, "errmsg", fmt.Sprintf("column %q used with different types (key, value, timestamp or state)", columnName))
 			return fmt.Errorf("%s", logContext...)
 		}
 	} else {
@@ -128,101 +178,442 @@ func setColumnType(logContext []interface{}, columnName string, ctype columnType
 // }
 
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a context to run in and a database to run on.
+//
+// Queries with a non-zero min_interval return the metrics cached by the previous execution until they are older than
+// min_interval.
+//
+// labels contains values of key labels not returned by the query (e.g. database of per_database collectors).
 func (q *Query) Collect(
 	ctx context.Context,
-	conn *sql.DB,
+	conn sqlQueryer,
+	symbols_table map[string]interface{},
+	labels map[string]string,
+	ch chan<- Metric) (int, error) {
+	if q.minInterval <= 0 {
+		return q.collect(ctx, conn, symbols_table, labels, ch)
+	}
+	if ctx.Err() != nil {
+		run := q.newRun(symbols_table)
+		ch <- run.fail(ctx, ctx.Err())
+		q.lastError.record(run.status, run.err)
+		return run.status, run.err
+	}
+
+	status, err := CollectorStatusOk, error(nil)
+
+	collTime := time.Now()
+	select {
+	case cacheTime := <-q.cacheSem:
+		// Have the lock.
+		if age := collTime.Sub(cacheTime); age > q.minInterval {
+			// Cache contents are older than minInterval, collect fresh metrics, cache them and pipe them through.
+			var logCtx []interface{}
+
+			logCtx = append(logCtx, q.logContext...)
+			logCtx = append(logCtx, "msg", fmt.Sprintf("Collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs",
+				q.minInterval.Seconds(), age.Seconds()))
+			q.logger.Debug("stacked", logCtx...)
+			cacheChan := make(chan Metric, capMetricChan)
+			q.cache = make([]Metric, 0, len(q.cache))
+			go func() {
+				q.cacheStatus, q.cacheErr = q.collect(ctx, conn, symbols_table, labels, cacheChan)
+				close(cacheChan)
+			}()
+			for metric := range cacheChan {
+				q.cache = append(q.cache, metric)
+				ch <- metric
+			}
+			cacheTime = collTime
+			status, err = q.cacheStatus, q.cacheErr
+		} else {
+			var logCtx []interface{}
+
+			logCtx = append(logCtx, q.logContext...)
+			logCtx = append(logCtx, "msg", fmt.Sprintf("Returning cached metrics: min_interval=%.3fs cache_age=%.3fs",
+				q.minInterval.Seconds(), age.Seconds()))
+			q.logger.Debug("stacked", logCtx...)
+			for _, metric := range q.cache {
+				ch <- metric
+			}
+			status, err = q.cacheStatus, q.cacheErr
+		}
+		// Always replace the value in the semaphore channel.
+		q.cacheSem <- cacheTime
+
+	case <-ctx.Done():
+		// Context closed, record an error and return
+		run := q.newRun(symbols_table)
+		ch <- run.fail(ctx, ctx.Err())
+		q.lastError.record(run.status, run.err)
+		status, err = run.status, run.err
+	}
+	return status, err
+}
+
+// collect runs the query, within its own timeout if set, and sends the metrics populated from the result rows. It
+// returns the status of the execution and the error that set it.
+func (q *Query) collect(
+	ctx context.Context,
+	conn sqlQueryer,
+	symbols_table map[string]interface{},
+	labels map[string]string,
+	ch chan<- Metric) (int, error) {
+	run := q.newRun(symbols_table)
+	defer func() {
+		q.lastError.record(run.status, run.err)
+	}()
+	q.collectRun(ctx, run, conn, symbols_table, labels, ch)
+	return run.status, run.err
+}
+
+// collectRun runs the query for the execution run.
+func (q *Query) collectRun(
+	ctx context.Context,
+	run *queryRun,
+	conn sqlQueryer,
 	symbols_table map[string]interface{},
+	labels map[string]string,
 	ch chan<- Metric) {
+	// wait for a slot of the target query limit, if any, before the query timeout starts.
+	release, err := acquireQuerySlot(ctx, q.order)
+	if err != nil {
+		ch <- run.fail(ctx, err)
+		return
+	}
+	defer release()
+	if q.stats != nil {
+		// count the series sent by the query until its execution is recorded.
+		start := time.Now()
+		out := ch
+		series := make(chan Metric, capMetricChan)
+		done := make(chan int)
+		go func() {
+			count := 0
+			for metric := range series {
+				if metric.Desc() != nil {
+					count++
+				}
+				out <- metric
+			}
+			done <- count
+		}()
+		ch = series
+		defer func() {
+			close(series)
+			q.stats.observe(time.Since(start), <-done, run.status)
+		}()
+	}
+	if q.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		defer cancel()
+	}
 	if ctx.Err() != nil {
-		ch <- NewInvalidMetric(q.logContext, ctx.Err())
+		ch <- run.fail(ctx, ctx.Err())
 		return
 	}
-	rows, err := q.run(ctx, conn, symbols_table)
+	acc := newRowsAccumulator()
+	if q.config.ForEach == nil {
+		if q.collectRows(ctx, run, conn, symbols_table, labels, acc, ch) {
+			run.partial(acc.Flush(ch))
+		}
+		return
+	}
+
+	items, err := q.forEachItems(ctx, conn, symbols_table)
 	if err != nil {
-		// TODO: increment an error counter
-		ch <- NewInvalidMetric(q.logContext, err)
+		ch <- run.fail(ctx, err)
 		return
 	}
+	// item columns are available to the dependent query as .item.<column> symbols
+	symbols := make(map[string]interface{}, len(symbols_table)+1)
+	maps.Copy(symbols, symbols_table)
+	for _, item := range items {
+		symbols["item"] = item
+		if len(labels) > 0 {
+			item = maps.Clone(item)
+			maps.Copy(item, labels)
+		}
+		if !q.collectRows(ctx, run, conn, symbols, item, acc, ch) && ctx.Err() != nil {
+			return
+		}
+	}
+	run.partial(acc.Flush(ch))
+}
+
+// collectRows runs the query and sends the metrics populated from the result rows, with key label columns not returned
+// by the query taken from the foreach item. It returns false if the query or the reading of rows failed.
+func (q *Query) collectRows(
+	ctx context.Context,
+	run *queryRun,
+	conn sqlQueryer,
+	symbols_table map[string]interface{},
+	item map[string]string,
+	acc *rowsAccumulator,
+	ch chan<- Metric) bool {
+	rows, err := q.run(ctx, conn, symbols_table)
+	if err != nil {
+		ch <- run.fail(ctx, err)
+		return false
+	}
 
 	// level.Debug(q.logger).Log("msg", fmt.Sprintf("opened rows %p", rows))
 	defer rows.Close()
 	// defer q.CloseTmp(rows)
 
-	dest, err := q.scanDest(rows)
+	dest, err := q.scanDest(rows, item)
 	if err != nil {
-		// TODO: increment an error counter
-		ch <- NewInvalidMetric(q.logContext, err)
-		return
+		q.stats.failed(queryStageScan)
+		ch <- run.fail(ctx, err)
+		return false
 	}
+	rows_count := 0
+	defer func() {
+		q.stats.addRows(rows_count)
+	}()
 	for rows.Next() {
+		rows_count++
 		row, err := q.scanRow(rows, dest)
 		if err != nil {
-			ch <- NewInvalidMetric(q.logContext, err)
+			q.stats.failed(queryStageScan)
+			ch <- run.fail(ctx, err)
 			continue
 		}
+		for column, value := range item {
+			if _, found := row[column]; !found && q.columnTypes[column] == columnTypeKey {
+				row[column] = value
+			}
+		}
 		for _, mf := range q.metricFamilies {
-			mf.Collect(row, ch)
+			run.partial(mf.Collect(row, acc, ch))
 		}
 	}
 	if err1 := rows.Err(); err1 != nil {
-		ch <- NewInvalidMetric(q.logContext, err1)
+		q.stats.failed(queryStageExecute)
+		ch <- run.fail(ctx, err1)
+		return false
+	}
+	return true
+}
+
+// queryRun is the result of an execution of a query: concurrent scrapes of a target run the same queries, so each
+// execution has its own.
+type queryRun struct {
+	logContext []interface{}
+	// driver of the target, to detect login errors
+	sqlDriver *SqlDriver
+	status    int
+	err       error
+}
+
+// newRun returns the result of a new execution of the query, ok until an error is reported.
+func (q *Query) newRun(symbols_table map[string]interface{}) *queryRun {
+	return &queryRun{
+		logContext: q.logContext,
+		sqlDriver:  sqlDrivers[GetMapValueString(symbols_table, "driver")],
+		status:     CollectorStatusOk,
 	}
 }
 
+// fail sets the status of the execution from the error (see errorStatus) and returns the invalid metric reporting the
+// error.
+func (r *queryRun) fail(ctx context.Context, err error) Metric {
+	r.status = errorStatus(ctx, err, r.sqlDriver)
+	r.err = err
+	return NewInvalidMetric(r.logContext, err)
+}
+
+// partial records the error of metrics that couldn't be built from the rows (already sent as invalid metrics): the
+// execution is partial, unless it failed.
+func (r *queryRun) partial(err error) {
+	if err == nil {
+		return
+	}
+	if r.status == CollectorStatusOk {
+		r.status = CollectorStatusPartial
+	}
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// sqlQueryer is the interface used to run queries, implemented by *sql.DB and by *sql.Conn (a connection pinned to a
+// database).
+type sqlQueryer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
 // run executes the query on the provided database, in the provided context.
 func (q *Query) run(
 	ctx context.Context,
-	conn *sql.DB,
+	queryer sqlQueryer,
 	symbols_table map[string]interface{}) (*sql.Rows, error) {
-	if q.conn != nil && q.conn != conn {
-		q.conn = nil
-		q.stmt.Close()
-		q.stmt = nil
-		//		panic(fmt.Sprintf("[%s] Expecting to always run on the same database handle", q.logContext))
-	}
-
-	if q.stmt == nil {
-		var query string
-		// check if query contains a Template or is raw sql.
-		// check if {{ is present in string
-		if strings.Contains(q.config.Query, "{{") {
-			tmpl, err := template.New("sql").Parse(q.config.Query)
-			if err != nil {
-				var logCtxt []interface{}
-				logCtxt = append(logCtxt, q.logContext...)
-				logCtxt = append(logCtxt, "msg", "prepare query failed with invalid template")
-				return nil, ErrorWrap(logCtxt, err)
-			}
-			b := new(strings.Builder)
-			err = tmpl.Execute(b, &symbols_table)
-			if err != nil {
-				var logCtxt []interface{}
-				logCtxt = append(logCtxt, q.logContext...)
-				logCtxt = append(logCtxt, "msg", "prepare query failed with invalid template render")
-				return nil, ErrorWrap(logCtxt, err)
-			}
-			query = b.String()
-		} else {
-			query = q.config.Query
+	// statement is only prepared on a database handle: a pinned connection is released after use.
+	conn, ok := queryer.(*sql.DB)
+	if !ok {
+		return q.runUnprepared(ctx, queryer, q.config.Query, q.config.template, q.config.Params, symbols_table)
+	}
+	// templated query: rendered on each execution (time functions, symbols changed since), so not prepared.
+	if q.config.template != nil {
+		return q.runUnprepared(ctx, conn, q.config.Query, q.config.template, q.config.Params, symbols_table)
+	}
+
+	stmt, err := q.prepare(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	args, err := queryArgs(q.config.Params, symbols_table)
+	if err != nil {
+		q.stats.failed(queryStageExecute)
+		return nil, ErrorWrap(q.logContext, err)
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		q.stats.failed(queryStageExecute)
+	}
+	return rows, ErrorWrap(q.logContext, err)
+}
+
+// prepare returns the statement of the query prepared on the database handle, prepared on first use.
+func (q *Query) prepare(ctx context.Context, conn *sql.DB) (*sql.Stmt, error) {
+	q.stmtsMutex.Lock()
+	stmt, ok := q.stmts[conn]
+	q.stmtsMutex.Unlock()
+	if ok {
+		return stmt, nil
+	}
+
+	query := q.config.Query
+	stmt, err := conn.PrepareContext(ctx, query)
+	if err != nil {
+		q.stats.failed(queryStagePrepare)
+		var logCtxt []interface{}
+		logCtxt = append(logCtxt, q.logContext...)
+		logCtxt = append(logCtxt, "query", query)
+		logCtxt = append(logCtxt, "msg", "prepare query failed")
+		return nil, ErrorWrap(logCtxt, err)
+	}
+	q.stmtsMutex.Lock()
+	defer q.stmtsMutex.Unlock()
+	if prev, ok := q.stmts[conn]; ok {
+		// prepared meanwhile by a concurrent run
+		stmt.Close()
+		return prev, nil
+	}
+	if q.stmts == nil {
+		q.stmts = make(map[*sql.DB]*sql.Stmt)
+	}
+	q.stmts[conn] = stmt
+	return stmt, nil
+}
+
+// closeStmts closes the statements prepared on the database handle, or all of them if nil.
+func (q *Query) closeStmts(conn *sql.DB) {
+	q.stmtsMutex.Lock()
+	defer q.stmtsMutex.Unlock()
+	for db, stmt := range q.stmts {
+		if conn == nil || db == conn {
+			stmt.Close()
+			delete(q.stmts, db)
 		}
-		stmt, err := conn.PrepareContext(ctx, query)
-		if err != nil {
+	}
+}
+
+// runUnprepared renders the query template if any, and executes the query on the provided database without preparing
+// it.
+func (q *Query) runUnprepared(
+	ctx context.Context,
+	conn sqlQueryer,
+	query string,
+	tmpl *template.Template,
+	params []string,
+	symbols_table map[string]interface{}) (*sql.Rows, error) {
+	if tmpl != nil {
+		var err error
+		driver := GetMapValueString(symbols_table, "driver")
+		if query, err = renderQueryTemplate(tmpl, driver, symbols_table); err != nil {
+			q.stats.failed(queryStagePrepare)
 			var logCtxt []interface{}
 			logCtxt = append(logCtxt, q.logContext...)
-			logCtxt = append(logCtxt, "query", query)
-			logCtxt = append(logCtxt, "msg", "prepare query failed")
+			logCtxt = append(logCtxt, "msg", "query failed with invalid template render")
 			return nil, ErrorWrap(logCtxt, err)
 		}
-		q.conn = conn
-		q.stmt = stmt
 	}
-	rows, err := q.stmt.QueryContext(ctx)
-	return rows, ErrorWrap(q.logContext, err)
+	args, err := queryArgs(params, symbols_table)
+	if err != nil {
+		q.stats.failed(queryStageExecute)
+		return nil, ErrorWrap(q.logContext, err)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		q.stats.failed(queryStageExecute)
+		var logCtxt []interface{}
+		logCtxt = append(logCtxt, q.logContext...)
+		logCtxt = append(logCtxt, "query", query)
+		return nil, ErrorWrap(logCtxt, err)
+	}
+	return rows, nil
+}
+
+// forEachItems runs the foreach source query and returns its rows, as maps of column name (lower case) to string
+// value (empty for NULL).
+func (q *Query) forEachItems(
+	ctx context.Context,
+	conn sqlQueryer,
+	symbols_table map[string]interface{}) ([]map[string]string, error) {
+	fe := q.config.ForEach
+	rows, err := q.runUnprepared(ctx, conn, fe.Query, fe.template, fe.Params, symbols_table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, ErrorWrap(q.logContext, err)
+	}
+	dest := make([]interface{}, len(columns))
+	for i := range dest {
+		dest[i] = new(sql.NullString)
+	}
+	items := make([]map[string]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			q.stats.failed(queryStageScan)
+			var logCtxt []interface{}
+			logCtxt = append(logCtxt, q.logContext...)
+			logCtxt = append(logCtxt, "msg", "scanning of foreach query result failed")
+			return nil, ErrorWrap(logCtxt, err)
+		}
+		item := make(map[string]string, len(columns))
+		for i, column := range columns {
+			item[strings.ToLower(column)] = dest[i].(*sql.NullString).String
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, ErrorWrap(q.logContext, err)
+	}
+	return items, nil
+}
+
+// queryArgs returns the values of the symbols bound to the query parameters.
+func queryArgs(params []string, symbols_table map[string]interface{}) ([]any, error) {
+	args := make([]any, 0, len(params))
+	for _, param := range params {
+		value, ok := GetMapValuePath(symbols_table, param)
+		if !ok {
+			return nil, fmt.Errorf("query parameter %q not found in target symbols", param)
+		}
+		args = append(args, value)
+	}
+	return args, nil
 }
 
 // scanDest creates a slice to scan the provided rows into, with strings for keys, float64s for values and interface{}
-// for any extra columns.
-func (q *Query) scanDest(rows *sql.Rows) ([]interface{}, error) {
+// for any extra columns. Key columns missing from the rows may be provided by the foreach item.
+func (q *Query) scanDest(rows *sql.Rows, item map[string]string) ([]interface{}, error) {
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, ErrorWrap(q.logContext, err)
@@ -299,6 +690,14 @@ func (q *Query) scanDest(rows *sql.Rows) ([]interface{}, error) {
 				dest = append(dest, new(float64))
 			}
 			have[column] = true
+		// timestamp is converted from the driver value: time, string or number
+		case columnTypeTimestamp:
+			dest = append(dest, new(interface{}))
+			have[column] = true
+		// state is kept as string, NULL meaning no current state
+		case columnTypeState:
+			dest = append(dest, new(sql.NullString))
+			have[column] = true
 		default:
 			var logCtx []interface{}
 
@@ -316,12 +715,17 @@ func (q *Query) scanDest(rows *sql.Rows) ([]interface{}, error) {
 	// Not all requested columns could be mapped, fail.
 	if len(have) != len(q.columnTypes) {
 		missing := make([]string, 0, len(q.columnTypes)-len(have))
-		for c := range q.columnTypes {
+		for c, ctype := range q.columnTypes {
+			if _, found := item[c]; found && ctype == columnTypeKey {
+				continue
+			}
 			if !have[c] {
 				missing = append(missing, c)
 			}
 		}
-		return nil, ErrorWrap(q.logContext, fmt.Errorf("column(s) %q missing from query result", missing))
+		if len(missing) > 0 {
+			return nil, ErrorWrap(q.logContext, fmt.Errorf("column(s) %q missing from query result", missing))
+		}
 	}
 
 	return dest, nil
@@ -363,7 +767,71 @@ func (q *Query) scanRow(rows *sql.Rows, dest []interface{}) (map[string]interfac
 			} else {
 				result[column] = *dest[i].(*float64)
 			}
+		case columnTypeTimestamp:
+			ts, err := toTimestamp(*dest[i].(*interface{}))
+			if err != nil {
+				var logCtxt []interface{}
+				logCtxt = append(logCtxt, q.logContext...)
+				logCtxt = append(logCtxt, "msg", fmt.Sprintf("invalid timestamp in column %q", column))
+				return nil, ErrorWrap(logCtxt, err)
+			}
+			result[column] = ts
+		case columnTypeState:
+			result[column] = *dest[i].(*sql.NullString)
 		}
 	}
 	return result, nil
 }
+
+// rowTimestamp is the value of a timestamp column: absolute is set for unix epoch numbers and strings with a time zone,
+// that are never converted to the metric timestamp_location.
+type rowTimestamp struct {
+	time     time.Time
+	absolute bool
+}
+
+// datetime formats accepted for timestamp returned as string: with time zone first.
+var timestampFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+const timestampFormatsWithZone = 3
+
+// toTimestamp converts the value of a timestamp column returned by the driver: NULL gives a zero time, numbers are
+// seconds since unix epoch and strings are parsed as numbers or datetimes (UTC if no time zone is given).
+func toTimestamp(value interface{}) (rowTimestamp, error) {
+	switch val := value.(type) {
+	case nil:
+		return rowTimestamp{}, nil
+	case time.Time:
+		return rowTimestamp{time: val}, nil
+	case int64:
+		return rowTimestamp{time: time.Unix(val, 0), absolute: true}, nil
+	case float64:
+		sec, frac := math.Modf(val)
+		return rowTimestamp{time: time.Unix(int64(sec), int64(frac*1e9)), absolute: true}, nil
+	case []byte:
+		return toTimestamp(string(val))
+	case string:
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return rowTimestamp{}, nil
+		}
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return toTimestamp(f)
+		}
+		for i, format := range timestampFormats {
+			if ts, err := time.Parse(format, val); err == nil {
+				return rowTimestamp{time: ts, absolute: i < timestampFormatsWithZone}, nil
+			}
+		}
+		return rowTimestamp{}, fmt.Errorf("unknown datetime format %q", val)
+	default:
+		return rowTimestamp{}, fmt.Errorf("unsupported type %T", value)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Self-metrics of the queries, exported with the exporter process metrics (/sql_exporter_metrics).
+var (
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: exporter_namespace,
+		Subsystem: "query",
+		Name:      "duration_seconds",
+		Help:      "Duration of the executions of the query in seconds (queue wait excluded).",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"target", "collector", "query"})
+	queryRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: exporter_namespace,
+		Subsystem: "query",
+		Name:      "rows_total",
+		Help:      "Number of rows returned by the query.",
+	}, []string{"target", "collector", "query"})
+	querySeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: exporter_namespace,
+		Subsystem: "query",
+		Name:      "series",
+		Help:      "Number of series produced by the last execution of the query.",
+	}, []string{"target", "collector", "query"})
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: exporter_namespace,
+		Subsystem: "query",
+		Name:      "errors_total",
+		Help:      "Number of failures of the query by stage: prepare, execute or scan (timeouts included).",
+	}, []string{"target", "collector", "query", "stage"})
+	queryTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: exporter_namespace,
+		Subsystem: "query",
+		Name:      "timeouts_total",
+		Help:      "Number of executions of the query interrupted by the scrape or query timeout.",
+	}, []string{"target", "collector", "query"})
+)
+
+func init() {
+	prometheus.MustRegister(queryDuration, queryRows, querySeries, queryErrors, queryTimeouts)
+}
+
+// Stages of query failures.
+const (
+	queryStagePrepare = "prepare"
+	queryStageExecute = "execute"
+	queryStageScan    = "scan"
+)
+
+// queryStats records the self-metrics of a query of a target; methods of a nil queryStats do nothing.
+type queryStats struct {
+	labels prometheus.Labels
+}
+
+// queryStatsRecorder is implemented by collectors recording the self-metrics of their queries.
+type queryStatsRecorder interface {
+	// RecordQueryStats enables the self-metrics of the queries, labelled with the target name.
+	RecordQueryStats(target string)
+}
+
+// RecordQueryStats implements queryStatsRecorder.
+func (c *collector) RecordQueryStats(target string) {
+	for _, q := range c.queries {
+		q.stats = &queryStats{
+			labels: prometheus.Labels{"target": target, "collector": c.config.Name, "query": q.config.Name},
+		}
+	}
+}
+
+// RecordQueryStats implements queryStatsRecorder.
+func (cc *cachingCollector) RecordQueryStats(target string) {
+	cc.rawColl.RecordQueryStats(target)
+}
+
+// recordQueryStats enables the self-metrics of the queries of the collector of the target. Targets created from a
+// model have none: each data source name sent by the scrapes would add series that are kept until reload.
+func recordQueryStats(c Collector, tpar *TargetConfig) {
+	if tpar.targetType != TargetTypeStatic {
+		return
+	}
+	if r, ok := c.(queryStatsRecorder); ok {
+		r.RecordQueryStats(tpar.Name)
+	}
+}
+
+// deleteQueryStats removes the self-metrics of the queries of the target (e.g. on reload).
+func deleteQueryStats(tpar *TargetConfig) {
+	if tpar.targetType == TargetTypeStatic {
+		labels := prometheus.Labels{"target": tpar.Name}
+		queryDuration.DeletePartialMatch(labels)
+		queryRows.DeletePartialMatch(labels)
+		querySeries.DeletePartialMatch(labels)
+		queryErrors.DeletePartialMatch(labels)
+		queryTimeouts.DeletePartialMatch(labels)
+	}
+}
+
+// failed records a failure of the query at the stage.
+func (s *queryStats) failed(stage string) {
+	if s == nil {
+		return
+	}
+	queryErrors.MustCurryWith(s.labels).WithLabelValues(stage).Inc()
+}
+
+// addRows records the number of rows read from the query result.
+func (s *queryStats) addRows(rows int) {
+	if s == nil || rows == 0 {
+		return
+	}
+	queryRows.With(s.labels).Add(float64(rows))
+}
+
+// observe records an execution of the query: its duration, the number of series produced and its timeout.
+func (s *queryStats) observe(duration time.Duration, series int, status int) {
+	if s == nil {
+		return
+	}
+	queryDuration.With(s.labels).Observe(duration.Seconds())
+	querySeries.With(s.labels).Set(float64(series))
+	if status == CollectorStatusTimeout {
+		queryTimeouts.With(s.labels).Inc()
+	}
+}
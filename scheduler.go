@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	lastRunAgeName      = "collector_last_run_age_seconds"
+	lastRunAgeHelp      = "Time since the end of the last background run of the collector in seconds"
+	lastRunDurationName = "collector_last_run_duration_seconds"
+	lastRunDurationHelp = "How long the last background run of the collector took in seconds"
+	lastRunSuccessName  = "collector_last_run_success"
+	lastRunSuccessHelp  = "if the last background run of the collector succeeded 1, else 0"
+)
+
+// targetSchedule holds the state of a target collected in background (scheduler mode): the latest snapshot of metrics
+// of each collector, served by the target Collect() without running any query.
+type targetSchedule struct {
+	// interval of each collector of the target (same order)
+	intervals []time.Duration
+
+	lastRunAgeDesc      MetricDesc
+	lastRunDurationDesc MetricDesc
+	lastRunSuccessDesc  MetricDesc
+
+	// serializes the target connection checks of the collectors
+	pingMutex sync.Mutex
+
+	// to protect the data below between the collector runs and the scrapes
+	mutex     sync.Mutex
+	running   bool
+	pinged    bool
+	up        bool
+	snapshots map[string]*collectorSnapshot
+}
+
+// collectorSnapshot is the result of the last completed run of a collector.
+type collectorSnapshot struct {
+	metrics  []Metric
+	up       bool
+	status   int
+	end      time.Time
+	duration time.Duration
+}
+
+// scheduledTarget returns true if the target or any of its collectors sets a scheduler_interval.
+func scheduledTarget(tpar *TargetConfig, ccs []*CollectorConfig) bool {
+	if tpar.Scheduler > 0 {
+		return true
+	}
+	for _, cc := range ccs {
+		if cc.Scheduler > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newTargetSchedule returns the schedule of a target with the interval of each collector: the collector value if set,
+// else the target one, else (only some collectors set an interval) the smallest interval of the collectors.
+func newTargetSchedule(
+	logContext []interface{},
+	tpar *TargetConfig,
+	ccs []*CollectorConfig,
+	gc *GlobalConfig,
+	constLabels []*dto.LabelPair) *targetSchedule {
+	s := &targetSchedule{
+		intervals: make([]time.Duration, len(ccs)),
+		snapshots: make(map[string]*collectorSnapshot, len(ccs)),
+	}
+	interval := time.Duration(tpar.Scheduler)
+	if interval <= 0 {
+		for _, cc := range ccs {
+			if cc.Scheduler > 0 && (interval <= 0 || time.Duration(cc.Scheduler) < interval) {
+				interval = time.Duration(cc.Scheduler)
+			}
+		}
+	}
+	for i, cc := range ccs {
+		s.intervals[i] = interval
+		if cc.Scheduler > 0 {
+			s.intervals[i] = time.Duration(cc.Scheduler)
+		}
+	}
+	labels := []string{"collector"}
+	s.lastRunAgeDesc = NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+lastRunAgeName, lastRunAgeHelp,
+		prometheus.GaugeValue, constLabels, labels...)
+	s.lastRunDurationDesc = NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+lastRunDurationName, lastRunDurationHelp,
+		prometheus.GaugeValue, constLabels, labels...)
+	s.lastRunSuccessDesc = NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+lastRunSuccessName, lastRunSuccessHelp,
+		prometheus.GaugeValue, constLabels, labels...)
+	return s
+}
+
+// Running returns true while the collectors of the target are run in background.
+func (s *targetSchedule) Running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running
+}
+
+// Scheduled implements Target.Scheduled: the target is collected in background.
+func (t *target) Scheduled() bool {
+	return t.schedule != nil
+}
+
+// RunScheduler implements Target.RunScheduler: each collector of the target runs on its own interval until the context
+// is done. A run still in progress when the next one is due delays it.
+func (t *target) RunScheduler(ctx context.Context) {
+	s := t.schedule
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.running = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.running = false
+		s.mutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(len(t.collectors))
+	for i, c := range t.collectors {
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(s.intervals[i])
+			defer ticker.Stop()
+			for {
+				t.runCollector(ctx, i, c)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runCollector checks the target connection, runs the collector within the target scrape timeout and stores the
+// collected metrics as the collector snapshot.
+func (t *target) runCollector(ctx context.Context, index int, c Collector) {
+	s := t.schedule
+	start := time.Now()
+	if timeout := time.Duration(t.config.ScrapeTimeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	snapshot := &collectorSnapshot{
+		metrics: make([]Metric, 0),
+		status:  CollectorStatusError,
+	}
+	conn, err := t.schedulePing(ctx)
+	if err != nil {
+		snapshot.metrics = append(snapshot.metrics, NewInvalidMetric(t.logContext, err))
+		snapshot.status = t.pingStatus(ctx, err)
+	} else {
+		snapshot.up = true
+		var slot *collectorSlot
+		if t.limiter != nil {
+			slot = &collectorSlot{limiter: t.limiter, collector: index}
+			ctx = withCollectorSlot(ctx, slot)
+		}
+		symbols := t.symbols()
+		ch := make(chan Metric, capMetricChan)
+		go func() {
+			c.Collect(ctx, conn, symbols, ch)
+			if t.config.Name != "" {
+				t.collectCacheStats(c, ch)
+			}
+			close(ch)
+		}()
+		for metric := range ch {
+			snapshot.metrics = append(snapshot.metrics, metric)
+		}
+		snapshot.status = c.Status()
+		if slot != nil && t.config.Name != "" {
+			snapshot.metrics = append(snapshot.metrics,
+				NewMetric(t.queueWaitDesc, float64(slot.waited.Load())*1e-9, []string{c.Name()}))
+		}
+	}
+	snapshot.end = time.Now()
+	snapshot.duration = snapshot.end.Sub(start)
+
+	s.mutex.Lock()
+	s.snapshots[c.Name()] = snapshot
+	s.mutex.Unlock()
+
+	t.content_mutex.Lock()
+	logger := t.logger
+	t.content_mutex.Unlock()
+	logger.Debug(fmt.Sprintf("scheduled collector run in %.3fs with status=%d", snapshot.duration.Seconds(), snapshot.status),
+		"target", t.config.Name, "collector", c.Name())
+}
+
+// schedulePing checks the target connection for a collector run; checks are serialized since they may (re)open the
+// connection. It returns the connection to run the collector on. A check that replaces the connection (new
+// credentials, login error) closes the previous one: the runs of other collectors still using it fail, and get the new
+// connection on their next run.
+func (t *target) schedulePing(ctx context.Context) (*sql.DB, error) {
+	s := t.schedule
+	s.pingMutex.Lock()
+	defer s.pingMutex.Unlock()
+	err := t.ping(ctx)
+	t.recordPing(ctx, err)
+
+	s.mutex.Lock()
+	s.pinged = true
+	s.up = err == nil
+	s.mutex.Unlock()
+	return t.getConn(), err
+}
+
+// collectSnapshots sends the metrics of the last run of the collectors (all of them or the specific ones requested),
+// with the age, duration and success of the runs.
+func (t *target) collectSnapshots(ch chan<- Metric, health_only bool) {
+	var (
+		scrapeStart = time.Now()
+		s           = t.schedule
+	)
+	// snapshots are never modified once stored: copy them and release the lock before sending metrics.
+	s.mutex.Lock()
+	pinged, up := s.pinged, s.up
+	snapshots := maps.Clone(s.snapshots)
+	s.mutex.Unlock()
+
+	if !pinged {
+		ch <- NewInvalidMetric(t.logContext, errors.New("no background run of the target completed yet"))
+		return
+	}
+	if t.config.Name != "" {
+		ch <- NewMetric(t.upDesc, boolToFloat64(up), nil)
+	}
+	if health_only {
+		return
+	}
+
+	colls := t.collectors
+	if specific := t.GetSpecificCollector(); specific != nil {
+		t.SetSpecificCollectorConfig(nil)
+		colls = specific
+	}
+	for _, c := range colls {
+		snapshot, found := snapshots[c.Name()]
+		if !found {
+			continue
+		}
+		for _, metric := range snapshot.metrics {
+			ch <- metric
+		}
+		if t.config.Name == "" {
+			continue
+		}
+		labels_value := []string{c.Name()}
+		ch <- NewMetric(t.collectorStatusDesc, float64(snapshot.status), labels_value)
+		ch <- NewMetric(s.lastRunAgeDesc, scrapeStart.Sub(snapshot.end).Seconds(), labels_value)
+		ch <- NewMetric(s.lastRunDurationDesc, snapshot.duration.Seconds(), labels_value)
+		ch <- NewMetric(s.lastRunSuccessDesc,
+			boolToFloat64(snapshot.up && snapshot.status == CollectorStatusOk), labels_value)
+	}
+	if t.config.Name != "" {
+		ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9, nil)
+	}
+}
@@ -1,4 +1,4 @@
-//go:build db2 && !hana && !mssql && !oracle
+//go:build db2
 
 package main
 
@@ -10,6 +10,15 @@ import (
 	_ "github.com/ibmdb/go_ibm_db" // register the DB2 driver
 )
 
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "go_ibm_db",
+		Aliases:         []string{"db2", "go_ibm_db"},
+		BuildConnection: BuildConnectionDb2,
+		CheckLoginError: check_login_error_db2,
+	})
+}
+
 // OpenConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
 // some driver supported DSN formats don't include a scheme), opens a DB handle ensuring early termination if the
 // context is closed (this is actually prevented by `database/sql` implementation), sets connection limits and returns
@@ -24,7 +33,7 @@ import (
 // DSN format!
 // 		DATABASE=<database>; HOSTNAME=<hostname>; PORT=<port>; PROTOCOL=<protocol>; UID=<login>; PWD=<password>;
 
-func BuildConnection(
+func BuildConnectionDb2(
 	logger *slog.Logger,
 	dsn string,
 	auth AuthConfig,
@@ -45,9 +54,9 @@ func BuildConnection(
 	// Adjust DSN, where necessary.
 	var params map[string]string
 	switch driver {
-	case "db2":
+	case "db2", "go_ibm_db":
 		var err error
-		if strings.HasPrefix(dsn, "db2://") {
+		if idx != -1 {
 			// "db2://<hostname>:<port>?user%20id=<login>&password=<password>&database=<database>&protocol=..."
 			params, err = splitConnectionStringURL(dsn)
 			if err != nil {
@@ -173,7 +182,7 @@ func genDSN(params map[string]string) string {
 // "ORA-01005: null password given; logon denied\n"
 //
 // "ORA-01017: invalid username/password; logon denied\n
-func check_login_error(err error) bool {
+func check_login_error_db2(err error) bool {
 	check := false
 	if strings.HasPrefix(err.Error(), "ORA-01005") ||
 		strings.HasPrefix(err.Error(), "ORA-01017") {
@@ -0,0 +1,292 @@
+//go:build goora
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	go_ora "github.com/sijms/go-ora/v2" // register the pure go Oracle driver
+	"github.com/sijms/go-ora/v2/network"
+)
+
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "oracle",
+		Aliases:         []string{"oracle", "oci8", "goora"},
+		BuildConnection: BuildConnectionGoOra,
+		CheckLoginError: check_login_error_goora,
+	})
+}
+
+// BuildConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
+// some driver supported DSN formats don't include a scheme), completes it with authentication parameters and returns
+// the final dsn passed to the driver.
+//
+// # Oracle (pure go)
+//
+// Using the https://github.com/sijms/go-ora driver (no cgo nor instant client), same formats as oci8 backend:
+//
+// url format "oracle://<hostname>:<port>/<instance>?user%20id=<login>&password=<password>&database=<database>&protocol=...&options="
+//
+// or:
+//
+// INSTANCE=<instance>; DATABASE=<database>; HOSTNAME=<hostname>; PORT=<port>; PROTOCOL=<protocol>; UID=<login>; PWD=<password>;
+//
+// When database is set, it is used as SERVICE_NAME, else instance is used as SID.
+//
+// Also accepted, optionally prefixed by "<login>/<password>@":
+//
+// * a full connect descriptor: (DESCRIPTION=(ADDRESS=(PROTOCOL=TCP)(HOST=<hostname>)(PORT=<port>))(CONNECT_DATA=(SERVICE_NAME=<service>)))
+//
+// * an EZConnect string: [//]<hostname>[:<port>]/<service>[:<server_type>][/<instance_name>]
+//
+// Any other data source name is passed unchanged to the driver, without authentication added.
+//
+// valid options are the go-ora ones (ssl, ssl verify, timeout, prefetch_rows, trace file, ...) and "as" (sysdba,
+// sysoper, ...) for compatibility with oci8 backend.
+func BuildConnectionGoOra(
+	logger *slog.Logger,
+	dsn string,
+	auth AuthConfig,
+	symbol_table map[string]any,
+	check_only bool) (string, error) {
+
+	var driver string
+
+	// Extract driver name from DSN.
+	idx := strings.Index(dsn, "://")
+	if idx == -1 {
+		driver = "oracle"
+	} else {
+		driver = dsn[:idx]
+	}
+
+	// Adjust DSN, where necessary.
+	var params map[string]string
+	switch driver {
+	case "oracle", "oci8", "goora":
+		var err error
+		if idx != -1 {
+			// "oracle://<hostname>:<port>/<instance>?user%20id=<login>&password=<password>&database=<database>&protocol=..."
+			params, err = splitConnectionStringURL(dsn)
+		} else if strings.Contains(strings.ToUpper(dsn), "(DESCRIPTION") {
+			// <login>/<password>@(DESCRIPTION=...)
+			params, err = splitOraConnectDescriptor(dsn)
+		} else if strings.Contains(dsn, ";") {
+			// DATABASE=<database>; HOSTNAME=<hostname>; PORT=<port>; PROTOCOL=<protocol>; UID=<login>; PWD=<password>;
+			params, err = splitRawConnectionStringDSN(dsn)
+		} else if oraEZConnectRE.MatchString(dsn) {
+			// <login>/<password>@//<hostname>:<port>/<service>
+			params, err = splitOraEZConnect(dsn)
+		} else {
+			if !check_only && symbol_table != nil {
+				// no password to decipher
+				symbol_table["params"] = map[string]string{"__need_auth_key": "false"}
+			}
+			return dsn, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if params["connect_descriptor"] == "" {
+			val, ok := params["server"]
+			if !ok || val == "" {
+				return "", fmt.Errorf("server can't be empty")
+			}
+
+			// 2 cases:
+			// a) old format: only instance is specified: it is the SID
+			// b) new for pdbs databases: database is specified: it is the SERVICE_NAME
+			if params["instance"] == "" && params["database"] == "" {
+				return "", fmt.Errorf("instance must be set")
+			}
+		}
+
+		val, ok := params["user id"]
+		if !ok || val == "" {
+			if auth.Username != "" {
+				params["user id"] = auth.Username
+			} else {
+				return "", fmt.Errorf("user Id can't be empty")
+			}
+		}
+
+		val, ok = params["password"]
+		if !ok || val == "" {
+			if auth.Password != "" {
+				val = string(auth.Password)
+			} else {
+				return "", fmt.Errorf("password has to be set")
+			}
+		}
+
+		if !check_only && symbol_table != nil {
+			passwd := val
+			if strings.HasPrefix(passwd, "/encrypted/") {
+				if val, auth_key, err := BuildPasswd(logger, passwd, symbol_table); err == nil {
+					params["password"] = val
+					params["__auth_key"] = auth_key
+				} else {
+					return "", fmt.Errorf("unable to decrypt password")
+				}
+				params["__need_auth_key"] = "true"
+			} else {
+				params["password"] = val
+				params["__need_auth_key"] = "false"
+			}
+
+			// add params to target symbol table
+			symbol_table["params"] = params
+		} else {
+			params["password"] = val
+		}
+
+	default:
+		return "", fmt.Errorf("driver '%s' not supported", driver)
+	}
+
+	// WARNING: display password in clear text in log !!!
+	// logger.Debug(fmt.Sprintf("private dsn='%s", dsn))
+
+	// rebuild dsn from params because params may have changed
+	return genDSNGoOra(params)
+}
+
+// splitOraConnectDescriptor parses "[<login>[/<password>]@](DESCRIPTION=...)": the descriptor is kept as is and passed
+// to the driver.
+func splitOraConnectDescriptor(dsn string) (map[string]string, error) {
+	res := map[string]string{}
+
+	idx := strings.Index(dsn, "(")
+	if credentials := strings.TrimSpace(dsn[:idx]); credentials != "" {
+		credentials, ok := strings.CutSuffix(credentials, "@")
+		if !ok {
+			return res, fmt.Errorf("invalid connect descriptor: missing '@' after credentials")
+		}
+		splitOraCredentials(credentials, res)
+	}
+	descriptor := strings.TrimSpace(dsn[idx:])
+	if strings.Count(descriptor, "(") != strings.Count(descriptor, ")") {
+		return res, fmt.Errorf("invalid connect descriptor: unbalanced parenthesis")
+	}
+	res["connect_descriptor"] = descriptor
+
+	return res, nil
+}
+
+// oraEZConnectRE matches "[<login>[/<password>]@][//]<hostname>[:<port>]/<service>[:<server_type>][/<instance_name>]".
+var oraEZConnectRE = regexp.MustCompile(
+	`^(?:.*@)?\s*(?://)?(?:\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9_.-]+)(?::[0-9]+)?/[A-Za-z0-9_.$#-]+` +
+		`(?::(?i:dedicated|shared|pooled))?(?:/[A-Za-z0-9_.$#-]+)?\s*$`)
+
+// splitOraEZConnect parses "[<login>[/<password>]@][//]<hostname>[:<port>]/<service>[:<server_type>][/<instance_name>]"
+func splitOraEZConnect(dsn string) (map[string]string, error) {
+	res := map[string]string{}
+
+	if idx := strings.LastIndex(dsn, "@"); idx != -1 {
+		splitOraCredentials(dsn[:idx], res)
+		dsn = dsn[idx+1:]
+	}
+	dsn = strings.TrimPrefix(strings.TrimSpace(dsn), "//")
+
+	address, service, found := strings.Cut(dsn, "/")
+	if !found || service == "" {
+		return res, fmt.Errorf("invalid EZConnect string: service name can't be empty")
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		res["server"] = host
+		res["port"] = port
+	} else {
+		res["server"] = strings.Trim(address, "[]")
+	}
+
+	service, instance, _ := strings.Cut(service, "/")
+	// server type (dedicated, shared, pooled) is not supported by driver
+	service, _, _ = strings.Cut(service, ":")
+	res["database"] = service
+	if instance != "" {
+		res["instance name"] = instance
+	}
+
+	return res, nil
+}
+
+// split "<login>[/<password>]" into params map
+func splitOraCredentials(credentials string, params map[string]string) {
+	user, passwd, found := strings.Cut(credentials, "/")
+	if user != "" {
+		params["user id"] = user
+	}
+	if found && passwd != "" {
+		params["password"] = passwd
+	}
+}
+
+// generate DSN string in go-ora url format from parameters map
+func genDSNGoOra(params map[string]string) (string, error) {
+	options := make(map[string]string)
+	for key, val := range params {
+		// skip parameters already set in url or name starting with '__'
+		switch key {
+		case "server", "port", "user id", "password", "database", "instance", "connect_descriptor", "protocol":
+			continue
+		case "as":
+			// oci8 option name for sysdba, sysoper...
+			key = "dba privilege"
+		}
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+		options[key] = val
+	}
+
+	if descriptor := params["connect_descriptor"]; descriptor != "" {
+		return go_ora.BuildJDBC(params["user id"], params["password"], descriptor, options), nil
+	}
+
+	// same default port than oci8 backend
+	port := 1531
+	if params["port"] != "" {
+		var err error
+		if port, err = strconv.Atoi(params["port"]); err != nil {
+			return "", fmt.Errorf("invalid port '%s'", params["port"])
+		}
+	}
+
+	// SID or SERVICE_NAME
+	service := params["database"]
+	if service == "" {
+		options["sid"] = params["instance"]
+	}
+	if strings.EqualFold(params["protocol"], "tcps") {
+		options["ssl"] = "true"
+	}
+	if len(options) == 0 {
+		options = nil
+	}
+
+	return go_ora.BuildUrl(params["server"], port, service, params["user id"], params["password"], options), nil
+}
+
+// Check if oracledb server returns an error message indicating
+// that something is wrong with password or login so that cnx is reset
+// and the next call, tries to recompute the login/passwd only if auth_key has changed.
+//
+// * "ORA-01005: null password given; logon denied\n"
+//
+// * "ORA-01017: invalid username/password; logon denied\n"
+func check_login_error_goora(err error) bool {
+	var oraErr *network.OracleError
+	if errors.As(err, &oraErr) {
+		return oraErr.ErrCode == 1005 || oraErr.ErrCode == 1017
+	}
+	return strings.HasPrefix(err.Error(), "ORA-01005") ||
+		strings.HasPrefix(err.Error(), "ORA-01017")
+}
@@ -1,16 +1,26 @@
-//go:build !db2 && hana && !mssql && !oracle
+//go:build hana
 
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
 	"strings"
 
-	_ "github.com/SAP/go-hdb/driver" // register the sap hana driver
+	"github.com/SAP/go-hdb/driver" // register the sap hana driver
 )
 
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "hdb",
+		Aliases:         []string{"hana", "hdb"},
+		BuildConnection: BuildConnectionHana,
+		CheckLoginError: check_login_error_hana,
+	})
+}
+
 // OpenConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
 // some driver supported DSN formats don't include a scheme), opens a DB handle ensuring early termination if the
 // context is closed (this is actually prevented by `database/sql` implementation), sets connection limits and returns
@@ -32,7 +42,7 @@ import (
 // * TLSRootCAFile=<>
 // * TLSServerName=<>
 // * TLSInsecureSkipVerify=<>
-func BuildConnection(
+func BuildConnectionHana(
 	logger *slog.Logger,
 	dsn string,
 	auth AuthConfig,
@@ -51,9 +61,9 @@ func BuildConnection(
 	// Adjust DSN, where necessary.
 	var params map[string]string
 	switch driver {
-	case "hdb":
+	case "hdb", "hana":
 		var err error
-		if strings.HasPrefix(dsn, "hdb://") {
+		if idx != -1 {
 			// "db2://<hostname>:<port>?user%20id=<login>&password=<password>&database=<database>&protocol=..."
 			params, err = splitConnectionStringURL(dsn)
 			if err != nil {
@@ -109,7 +119,8 @@ func BuildConnection(
 	}
 
 	// rebuild dsn from params because params may have changed
-	return genDSNUrlHana(driver, params), nil
+	// aliases (hana://) are passed to the driver with its scheme.
+	return genDSNUrlHana("hdb", params), nil
 }
 
 // generate DSN string in url format from parameters map
@@ -172,14 +183,16 @@ func genDSNUrlHana(driver string, params map[string]string) string {
 // that something is wrong with password or login so that cnx is reset
 // and the next call, tries to recompute the login/passwd only if auth_key has changed.
 //
-// "ORA-01005: null password given; logon denied\n"
+// "SQL Error 10 - authentication failed"
+//
+// "SQL Error 414 - user is forced to change password"
 //
-// "ORA-01017: invalid username/password; logon denied\n
-func check_login_error(err error) bool {
-	check := false
-	if strings.HasPrefix(err.Error(), "ORA-01005") ||
-		strings.HasPrefix(err.Error(), "ORA-01017") {
-		check = true
+// "SQL Error 416 - user is deactivated"
+func check_login_error_hana(err error) bool {
+	var hdbErr driver.Error
+	if errors.As(err, &hdbErr) {
+		code := hdbErr.Code()
+		return code == 10 || code == 414 || code == 416
 	}
-	return check
+	return strings.Contains(err.Error(), "authentication failed")
 }
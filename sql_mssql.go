@@ -1,16 +1,31 @@
-//go:build !db2 && !hana && mssql && !oracle
+//go:build mssql
 
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/url"
 	"strings"
 
-	_ "github.com/microsoft/go-mssqldb" // register the MS-SQL driver
+	mssql "github.com/microsoft/go-mssqldb" // register the MS-SQL driver
 )
 
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "sqlserver",
+		Aliases:         []string{"mssql", "sqlserver"},
+		BuildConnection: BuildConnectionMssql,
+		CheckLoginError: check_login_error_mssql,
+		ListDatabases:   "SELECT name FROM sys.databases WHERE state = 0 AND HAS_DBACCESS(name) = 1",
+		CurrentDatabase: "SELECT DB_NAME()",
+		UseDatabase: func(database string) string {
+			return "USE [" + strings.ReplaceAll(database, "]", "]]") + "]"
+		},
+	})
+}
+
 // OpenConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
 // some driver supported DSN formats don't include a scheme), opens a DB handle ensuring early termination if the
 // context is closed (this is actually prevented by `database/sql` implementation), sets connection limits and returns
@@ -27,7 +42,7 @@ import (
 // or DSN format:
 //
 //	DATABASE=<database>; HOSTNAME=<hostname>; PORT=<port>; PROTOCOL=<protocol>; UID=<login>; PWD=<password>;
-func BuildConnection(
+func BuildConnectionMssql(
 	logger *slog.Logger,
 	dsn string,
 	auth AuthConfig,
@@ -46,9 +61,9 @@ func BuildConnection(
 	// Adjust DSN, where necessary.
 	var params map[string]string
 	switch driver {
-	case "sqlserver":
+	case "sqlserver", "mssql":
 		var err error
-		if strings.HasPrefix(dsn, "sqlserver://") {
+		if idx != -1 {
 			// "sqlserver://<hostname>:<port>/<path>?user%20id=<login>&password=<password>&database=<database>&protocol=..."
 			params, err = splitConnectionStringURL(dsn)
 			if err != nil {
@@ -115,7 +130,8 @@ func BuildConnection(
 	}
 
 	// rebuild dsn from params because params may have changed
-	return genDSNUrl(driver, params), nil
+	// aliases (mssql://) are passed to the driver with its scheme.
+	return genDSNUrl("sqlserver", params), nil
 }
 
 // generate DSN string in url format from parameters map
@@ -164,14 +180,13 @@ func genDSNUrl(driver string, params map[string]string) string {
 // that something is wrong with password or login so that cnx is reset
 // and the next call, tries to recompute the login/passwd only if auth_key has changed.
 //
-// "ORA-01005: null password given; logon denied\n"
+// "mssql: login error: Login failed for user 'xxx'." (error 18456)
 //
-// "ORA-01017: invalid username/password; logon denied\n
-func check_login_error(err error) bool {
-	check := false
-	if strings.HasPrefix(err.Error(), "ORA-01005") ||
-		strings.HasPrefix(err.Error(), "ORA-01017") {
-		check = true
+// "mssql: login error: Login failed for user 'xxx'. Reason: The password of the account has expired." (error 18487, 18488)
+func check_login_error_mssql(err error) bool {
+	var msErr mssql.Error
+	if errors.As(err, &msErr) {
+		return msErr.Number == 18456 || msErr.Number == 18487 || msErr.Number == 18488
 	}
-	return check
+	return strings.Contains(err.Error(), "Login failed for user")
 }
@@ -1,4 +1,4 @@
-//go:build !db2 && !hana && !mssql && oracle
+//go:build oracle && !goora
 
 package main
 
@@ -12,6 +12,15 @@ import (
 	// register the Oracle OCI-8 driver
 )
 
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "oci8",
+		Aliases:         []string{"oracle", "oci8"},
+		BuildConnection: BuildConnectionOracle,
+		CheckLoginError: check_login_error_oracle,
+	})
+}
+
 // OpenConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
 // some driver supported DSN formats don't include a scheme), opens a DB handle ensuring early termination if the
 // context is closed (this is actually prevented by `database/sql` implementation), sets connection limits and returns
@@ -36,7 +45,7 @@ import (
 //	 - prefetch_memory
 //	 - as
 //	 - stmt_cache_size
-func BuildConnection(
+func BuildConnectionOracle(
 	logger *slog.Logger,
 	dsn string,
 	auth AuthConfig,
@@ -250,7 +259,7 @@ func BuildConnection(
 // * "ORA-01005: null password given; logon denied\n"
 //
 // * "ORA-01017: invalid username/password; logon denied\n"
-func check_login_error(err error) bool {
+func check_login_error_oracle(err error) bool {
 	check := false
 	if strings.HasPrefix(err.Error(), "ORA-01005") ||
 		strings.HasPrefix(err.Error(), "ORA-01017") {
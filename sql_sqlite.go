@@ -0,0 +1,118 @@
+//go:build sqlite
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"modernc.org/sqlite" // register the pure go SQLite driver
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func init() {
+	RegisterSqlDriver(&SqlDriver{
+		Name:            "sqlite",
+		Aliases:         []string{"sqlite", "sqlite3", "file"},
+		BuildConnection: BuildConnectionSqlite,
+		CheckLoginError: check_login_error_sqlite,
+	})
+}
+
+// BuildConnection extracts the driver name from the DSN (expected as the URI scheme), adjusts it where necessary (e.g.
+// some driver supported DSN formats don't include a scheme) and returns the final dsn passed to the driver.
+//
+// # SQLite
+//
+// Using the https://gitlab.com/cznic/sqlite pure go driver (no cgo), DSN format:
+//
+// url format:
+//
+//	sqlite:///path/to/database.db?param=value
+//
+// or a plain file name:
+//
+//	/path/to/database.db
+//
+// Database is opened read-only (mode=ro) unless another mode is set, so that a wrong path doesn't create an empty
+// database. Valid parameters are the sqlite URI parameters (mode, cache, immutable, ...) and the driver ones:
+//
+// * _pragma=<pragma(value)> (may be repeated)
+// * _time_format=sqlite
+// * _txlock=<deferred|immediate|exclusive>
+//
+// SQLite has no authentication: auth_config is ignored.
+func BuildConnectionSqlite(
+	logger *slog.Logger,
+	dsn string,
+	auth AuthConfig,
+	symbol_table map[string]any,
+	check_only bool) (string, error) {
+
+	var driver, path string
+	// Extract driver name from DSN.
+	idx := strings.Index(dsn, "://")
+	if idx == -1 {
+		driver = "sqlite"
+		path = dsn
+	} else {
+		driver = dsn[:idx]
+		path = dsn[idx+3:]
+	}
+
+	// Adjust DSN, where necessary.
+	var query url.Values
+	switch driver {
+	case "sqlite", "sqlite3", "file":
+		var (
+			raw_query string
+			err       error
+		)
+		path, raw_query, _ = strings.Cut(strings.TrimPrefix(path, "file:"), "?")
+		if path == "" {
+			return "", fmt.Errorf("database file can't be empty")
+		}
+		query, err = url.ParseQuery(raw_query)
+		if err != nil {
+			return "", err
+		}
+		if query.Get("mode") == "" && path != ":memory:" {
+			query.Set("mode", "ro")
+		}
+
+		if !check_only && symbol_table != nil {
+			params := make(map[string]string, len(query)+2)
+			for key, val := range query {
+				params[key] = strings.Join(val, ",")
+			}
+			params["database"] = path
+			// no password so no auth_key
+			params["__need_auth_key"] = "false"
+
+			// add params to target symbol table
+			symbol_table["params"] = params
+		}
+	default:
+		return "", fmt.Errorf("driver '%s' not supported", driver)
+	}
+
+	if len(query) == 0 {
+		return "file:" + path, nil
+	}
+	return "file:" + path + "?" + query.Encode(), nil
+}
+
+// Check if sqlite returns an error indicating
+// that something is wrong with authorization so that cnx is reset.
+//
+// * SQLITE_AUTH (23): authorization denied
+func check_login_error_sqlite(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqlite3.SQLITE_AUTH
+	}
+	return false
+}
@@ -186,6 +186,23 @@ func GetMapValueMap(symtab map[string]any, key string) map[string]any {
 	return wanted_map
 }
 
+// extract value from symbol table following a dotted path through nested maps (e.g. "params.database")
+func GetMapValuePath(symtab map[string]any, path string) (any, bool) {
+	key, rest, nested := strings.Cut(path, ".")
+	value_raw, ok := symtab[key]
+	if !ok || !nested {
+		return value_raw, ok
+	}
+	switch value_val := value_raw.(type) {
+	case map[string]any:
+		return GetMapValuePath(value_val, rest)
+	case map[string]string:
+		value, ok := value_val[rest]
+		return value, ok
+	}
+	return nil, false
+}
+
 // generate DSN string in url format from parameters map
 // func GenDSNUrl(driver string, params map[string]string) string {
 
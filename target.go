@@ -6,6 +6,7 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"log/slog"
+	"maps"
 	"reflect"
 	"sort"
 	"sync"
@@ -25,7 +26,13 @@ const (
 	scrapeDurationName  = "scrape_duration_seconds"
 	scrapeDurationHelp  = "How long it took to scrape the target in seconds"
 	collectorStatusName = "collector_status"
-	collectorStatusHelp = "collector scripts status 0: error - 1: ok - 2: Invalid login 3: Timeout"
+	collectorStatusHelp = "collector scripts status 0: error - 1: ok - 2: Invalid login 3: Timeout 4: Partial (some queries failed)"
+	queueWaitName       = "query_queue_wait_seconds"
+	queueWaitHelp       = "How long the queries of the collector waited for a slot of max_concurrent_queries in seconds"
+	cacheAgeName        = "collector_cache_age_seconds"
+	cacheAgeHelp        = "Age of the cached metrics returned by the collector in seconds"
+	cacheFailuresName   = "collector_cache_refresh_failures_total"
+	cacheFailuresHelp   = "Number of failed background refreshes of the collector cache"
 )
 
 // Target collects SQL metrics from a single sql.DB instance. It aggregates one or more Collectors and it looks much
@@ -41,6 +48,12 @@ type Target interface {
 	GetSpecificCollector() []Collector
 	SetSpecificCollectorConfig(coll map[string]*CollectorConfig) error
 	SetLogger(*slog.Logger)
+	// Scheduled returns true if the target is collected in background (scheduler mode).
+	Scheduled() bool
+	// RunScheduler runs the collectors of the target in background until the context is done.
+	RunScheduler(ctx context.Context)
+	// TargetStatus returns the last errors of the target connection, of its collectors and of their queries.
+	TargetStatus() *TargetStatus
 	Lock()
 	Unlock()
 	CloseCnx()
@@ -57,8 +70,18 @@ type target struct {
 	upDesc              MetricDesc
 	scrapeDurationDesc  MetricDesc
 	collectorStatusDesc MetricDesc
+	queueWaitDesc       MetricDesc
+	cacheAgeDesc        MetricDesc
+	cacheFailuresDesc   MetricDesc
 	logContext          []interface{}
 
+	// limit of queries running concurrently, nil if not set
+	limiter *queryLimiter
+	// background collection, nil if not in scheduler mode
+	schedule *targetSchedule
+	// status, last error and consecutive failures of the connection, for the target status page
+	lastError errorState
+
 	conn   *sql.DB
 	logger *slog.Logger
 
@@ -103,10 +126,15 @@ func NewTarget(
 	constLabelPairs := build_ConstantLabels(tpar.Labels)
 	collectors := make([]Collector, 0, len(ccs))
 	for _, cc := range ccs {
-		c, err := NewCollector(logContext, logger, cc, constLabelPairs)
+		c, err := NewCollector(logContext, logger, cc, constLabelPairs, tpar.CollectorVariables(gc, cc))
 		if err != nil {
 			return nil, err
 		}
+		recordQueryStats(c, tpar)
+		// cache of collectors of static targets saved across restarts.
+		if p, ok := c.(cachePersister); ok && gc.CacheDir != "" && tpar.targetType == TargetTypeStatic && tpar.DSN != "template" {
+			p.PersistCache(tpar.Name, cacheFileName(gc.CacheDir, tpar.Name, cc.Name))
+		}
 		collectors = append(collectors, c)
 	}
 
@@ -134,6 +162,37 @@ func NewTarget(
 		labels...,
 	)
 
+	queueWaitDesc := NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+queueWaitName,
+		queueWaitHelp,
+		prometheus.GaugeValue, constLabelPairs,
+		labels...,
+	)
+
+	cacheAgeDesc := NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+cacheAgeName,
+		cacheAgeHelp,
+		prometheus.GaugeValue, constLabelPairs,
+		labels...,
+	)
+	cacheFailuresDesc := NewAutomaticMetricDesc(logContext,
+		gc.NameSpace+"_"+cacheFailuresName,
+		cacheFailuresHelp,
+		prometheus.CounterValue, constLabelPairs,
+		labels...,
+	)
+
+	var limiter *queryLimiter
+	if max_queries := tpar.MaxConcurrentQueries(gc); max_queries > 0 {
+		limiter = newQueryLimiter(max_queries)
+	}
+
+	// only static targets are collected in background; dynamic ones are created by a scrape.
+	var schedule *targetSchedule
+	if scheduledTarget(tpar, ccs) && tpar.DSN != "template" && tpar.targetType == TargetTypeStatic {
+		schedule = newTargetSchedule(logContext, tpar, ccs, gc, constLabelPairs)
+	}
+
 	symbols_table := make(map[string]interface{}, 2)
 
 	t := target{
@@ -145,7 +204,12 @@ func NewTarget(
 		upDesc:              upDesc,
 		scrapeDurationDesc:  scrapeDurationDesc,
 		collectorStatusDesc: collectorStatusDesc,
+		queueWaitDesc:       queueWaitDesc,
+		cacheAgeDesc:        cacheAgeDesc,
+		cacheFailuresDesc:   cacheFailuresDesc,
 		logContext:          logContext,
+		limiter:             limiter,
+		schedule:            schedule,
 		logger:              logger,
 		symbols_table:       symbols_table,
 		content_mutex:       &sync.Mutex{},
@@ -171,15 +235,20 @@ func (t *target) Config() *TargetConfig {
 //
 // May be unitary key (.attribute) or sequence (.attr1.attr2.[...])
 func (t *target) SetSymbol(key string, value any) error {
+	t.content_mutex.Lock()
+	defer t.content_mutex.Unlock()
 	symtab := t.symbols_table
 	if r_val, ok := symtab[key]; ok {
 		vDst := reflect.ValueOf(r_val)
 		if vDst.Kind() == reflect.Map {
 			if m_val, ok := r_val.(map[string]any); ok {
+				// merge into a copy: runs hold copies of the symbols table that share its maps.
+				m_val = maps.Clone(m_val)
 				opts := mergo.WithOverride
 				if err := mergo.Merge(&m_val, value, opts); err != nil {
 					return err
 				}
+				symtab[key] = m_val
 			}
 		} else if vDst.Kind() == reflect.Slice {
 			if s_val, ok := r_val.([]any); ok {
@@ -198,13 +267,23 @@ func (t *target) SetSymbol(key string, value any) error {
 }
 
 func (t *target) GetSymbolTable() map[string]any {
-	return t.symbols_table
+	return t.symbols()
 }
 
 func (t *target) DeleteSymbol(key string) {
+	t.content_mutex.Lock()
+	defer t.content_mutex.Unlock()
 	delete(t.symbols_table, key)
 }
 
+// symbols returns a copy of the symbols table for a run: the table is updated (connection params, authentication)
+// while the collectors of other runs read it.
+func (t *target) symbols() map[string]any {
+	t.content_mutex.Lock()
+	defer t.content_mutex.Unlock()
+	return maps.Clone(t.symbols_table)
+}
+
 func (t *target) GetSpecificCollector() []Collector {
 	if t.collector_config != nil {
 		return t.specific_collectors
@@ -229,10 +308,12 @@ func (t *target) SetSpecificCollectorConfig(colls map[string]*CollectorConfig) e
 			// there was no previous specific collectors... build list
 			if t.specific_collectors == nil {
 				constLabelPairs = build_ConstantLabels(t.config.Labels)
-				coll, err := NewCollector(t.logContext, logger, coll_config, constLabelPairs)
+				coll, err := NewCollector(t.logContext, logger, coll_config, constLabelPairs,
+					t.config.CollectorVariables(t.globalConfig, coll_config))
 				if err != nil {
 					return err
 				}
+				recordQueryStats(coll, t.config)
 				coll_list = append(coll_list, coll)
 				// else has previous, need to check if name found in list
 			} else {
@@ -241,10 +322,12 @@ func (t *target) SetSpecificCollectorConfig(colls map[string]*CollectorConfig) e
 						if constLabelPairs == nil {
 							constLabelPairs = build_ConstantLabels(t.config.Labels)
 						}
-						coll, err = NewCollector(t.logContext, logger, coll_config, constLabelPairs)
+						coll, err = NewCollector(t.logContext, logger, coll_config, constLabelPairs,
+							t.config.CollectorVariables(t.globalConfig, coll_config))
 						if err != nil {
 							return err
 						}
+						recordQueryStats(coll, t.config)
 					}
 					coll_list = append(coll_list, coll)
 				}
@@ -275,13 +358,10 @@ func (t *target) Unlock() {
 }
 
 func (t *target) CloseCnx() {
-	t.content_mutex.Lock()
-	if t.conn != nil {
-		t.conn.Close()
-		t.conn = nil
-	}
-	t.content_mutex.Unlock()
-
+	t.setConn(nil)
+	// per_database collectors have their own connections.
+	closeDatabaseConns(t.collectors)
+	closeDatabaseConns(t.specific_collectors)
 }
 
 // Collect implements Target.
@@ -291,7 +371,14 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric, health_only bool
 		targetUp    = true
 	)
 
+	// in scheduler mode, serve the metrics of the last background runs.
+	if t.schedule != nil && t.schedule.Running() {
+		t.collectSnapshots(ch, health_only)
+		return
+	}
+
 	err := t.ping(ctx)
+	t.recordPing(ctx, err)
 	if err != nil {
 		ch <- NewInvalidMetric(t.logContext, err)
 		targetUp = false
@@ -306,21 +393,37 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric, health_only bool
 
 	var wg sync.WaitGroup
 	var colls []Collector
+	var slots []*collectorSlot
 
-	// Don't bother with the collectors if target is down.
-	if targetUp {
-		if colls = t.GetSpecificCollector(); colls != nil {
-			t.SetSpecificCollectorConfig(nil)
-		} else {
-			colls = t.collectors
+	if colls = t.GetSpecificCollector(); colls != nil {
+		t.SetSpecificCollectorConfig(nil)
+		// specific collectors are built for this scrape only: release their connections once done.
+		defer closeDatabaseConns(colls)
+	} else {
+		colls = t.collectors
+	}
+	// Don't bother with the collectors if target is down: they all fail for the reason of the connection error.
+	if !targetUp {
+		status := t.pingStatus(ctx, err)
+		for _, c := range colls {
+			c.SetStatus(status)
 		}
-
+	} else {
+		conn := t.getConn()
+		symbols := t.symbols()
 		wg.Add(len(colls))
-		for _, c := range colls {
+		slots = make([]*collectorSlot, len(colls))
+		for i, c := range colls {
+			// queries wait for a slot of the target limit in the order of collectors, then of queries in collector.
+			coll_ctx := ctx
+			if t.limiter != nil {
+				slots[i] = &collectorSlot{limiter: t.limiter, collector: i}
+				coll_ctx = withCollectorSlot(ctx, slots[i])
+			}
 			// If using a single DB connection, collectors will likely run sequentially anyway. But we might have more.
 			go func(collector Collector) {
 				defer wg.Done()
-				collector.Collect(ctx, t.conn, t.symbols_table, ch)
+				collector.Collect(coll_ctx, conn, symbols, ch)
 			}(c)
 		}
 	}
@@ -333,16 +436,24 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric, health_only bool
 
 	if t.config.Name != "" {
 		// And exporter a `collector execution status` metric for each collector once we're done scraping.
+		labels_value := make([]string, 1)
+		for _, c := range colls {
+			labels_value[0] = c.Name()
+			logger.Debug(
+				fmt.Sprintf("target collector['%s'] has status=%d", labels_value[0], c.Status()),
+				"target", t.config.Name)
+			ch <- NewMetric(t.collectorStatusDesc, float64(c.Status()), labels_value)
+		}
 		if targetUp {
-			labels_name := make([]string, 1)
-			labels_name[0] = "collectorname"
-			labels_value := make([]string, 1)
+			// cache age and refresh failures of collectors refreshing in background.
 			for _, c := range colls {
-				labels_value[0] = c.Name()
-				logger.Debug(
-					fmt.Sprintf("target collector['%s'] has status=%d", labels_value[0], c.Status()),
-					"target", t.config.Name)
-				ch <- NewMetric(t.collectorStatusDesc, float64(c.Status()), labels_value)
+				t.collectCacheStats(c, ch)
+			}
+			// time spent by the queries of each collector waiting for a slot.
+			if t.limiter != nil {
+				for i, c := range colls {
+					ch <- NewMetric(t.queueWaitDesc, float64(slots[i].waited.Load())*1e-9, []string{c.Name()})
+				}
 			}
 		}
 		// And export a `scrape duration` metric once we're done scraping.
@@ -350,11 +461,41 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric, health_only bool
 	}
 }
 
+// collectCacheStats sends the age of the cached metrics and the number of failed refreshes of a collector refreshing
+// its cache in background (stale_while_revalidate).
+func (t *target) collectCacheStats(c Collector, ch chan<- Metric) {
+	stats, ok := c.(cacheStats)
+	if !ok {
+		return
+	}
+	if age, failures, ok := stats.CacheStats(); ok {
+		ch <- NewMetric(t.cacheAgeDesc, age.Seconds(), []string{c.Name()})
+		ch <- NewMetric(t.cacheFailuresDesc, float64(failures), []string{c.Name()})
+	}
+}
+
+// recordPing records the result of a connection check of the target, for the target status page.
+func (t *target) recordPing(ctx context.Context, err error) {
+	if err != nil {
+		t.lastError.record(t.pingStatus(ctx, err), err)
+	} else {
+		t.lastError.record(CollectorStatusOk, nil)
+	}
+}
+
+// pingStatus returns the status of the collectors of the target when the connection check failed with the error:
+// invalid login or timeout if recognized, else error.
+func (t *target) pingStatus(ctx context.Context, err error) int {
+	sql_driver, _ := t.config.SqlDriver()
+	return errorStatus(ctx, err, sql_driver)
+}
+
 func (t *target) hasChangedAuthKey() bool {
 	var auth_key, old_auth_key, need_auth_key string
 	res := false
+	symbols := t.symbols()
 	// if set else do nothing
-	params := GetMapValueMap(t.symbols_table, "params")
+	params := GetMapValueMap(symbols, "params")
 	if params != nil {
 		need_auth_key = GetMapValueString(params, "__need_auth_key")
 		if need_auth_key == "false" {
@@ -365,7 +506,7 @@ func (t *target) hasChangedAuthKey() bool {
 		// probably first call to ping...
 		res = true
 	}
-	auth_key = GetMapValueString(t.symbols_table, "__auth_key")
+	auth_key = GetMapValueString(symbols, "__auth_key")
 	// it has changed, so reset the dsn value so it can be recomputed
 	if auth_key != old_auth_key {
 		res = true
@@ -385,18 +526,24 @@ func (t *target) ping(ctx context.Context) error {
 		if t.private_dsn != "" {
 			t.private_dsn = ""
 		}
-		if t.conn != nil {
-			t.conn.Close()
-			t.conn = nil
-		}
+		t.setConn(nil)
 	}
 
-	if t.conn == nil {
+	sql_driver, err := t.config.SqlDriver()
+	if err != nil {
+		return ErrorWrap(t.logContext, err)
+	}
+
+	if t.getConn() == nil {
+		// build the connection on a copy of the symbols table, set back once done: collectors may be reading it.
+		symbols := t.symbols()
+		// dialect for query templates quote functions
+		symbols["driver"] = sql_driver.Name
 		if t.private_dsn == "" {
-			if val, err := BuildConnection(t.logger,
+			if val, err := sql_driver.BuildConnection(t.logger,
 				string(t.config.DSN),
 				t.config.AuthConfig,
-				t.symbols_table,
+				symbols,
 				false,
 			); err == nil {
 				t.private_dsn = val
@@ -404,11 +551,17 @@ func (t *target) ping(ctx context.Context) error {
 				return ErrorWrap(t.logContext, err)
 			}
 		}
+		t.content_mutex.Lock()
+		t.symbols_table["driver"] = symbols["driver"]
+		if params, ok := symbols["params"]; ok {
+			t.symbols_table["params"] = params
+		}
+		t.content_mutex.Unlock()
 
 		conn, err := OpenConnection(ctx,
 			t.logContext,
 			t.logger,
-			driver_name,
+			sql_driver.Name,
 			t.private_dsn,
 			t.globalConfig.MaxConns, t.globalConfig.MaxIdleConns,
 		)
@@ -418,37 +571,57 @@ func (t *target) ping(ctx context.Context) error {
 			}
 			// if err == ctx.Err() fall through
 		} else {
-			t.conn = conn
+			t.setConn(conn)
 		}
 	}
 
 	// If we have a handle and the context is not closed, test whether the database is up.
-	if t.conn != nil && ctx.Err() == nil {
+	if conn := t.getConn(); conn != nil && ctx.Err() == nil {
 		var err error
 		// Ping up to max_connections + 1 times as long as the returned error is driver.ErrBadConn, to purge the connection
 		// pool of bad connections. This might happen if the previous scrape timed out and in-flight queries got canceled.
 		for i := 0; i <= t.globalConfig.MaxConns; i++ {
-			if err = PingDB(ctx, t.conn); err != driver.ErrBadConn {
+			if err = PingDB(ctx, conn); err != driver.ErrBadConn {
 				break
 			}
 		}
 		if err != nil {
-			if check_login_error(err) {
-				t.conn.Close()
-				t.conn = nil
+			if sql_driver.CheckLoginError(err) {
+				t.setConn(nil)
 			}
 			return ErrorWrap(t.logContext, err)
 		}
 	}
 
 	if ctx.Err() != nil {
-		t.conn.Close()
-		t.conn = nil
+		// in scheduler mode, the expired run of a collector doesn't close the connection of the others.
+		if t.schedule == nil {
+			t.setConn(nil)
+		}
 		return ErrorWrap(t.logContext, ctx.Err())
 	}
 	return nil
 }
 
+// getConn returns the connection of the target.
+func (t *target) getConn() *sql.DB {
+	t.content_mutex.Lock()
+	defer t.content_mutex.Unlock()
+	return t.conn
+}
+
+// setConn replaces the connection of the target, closing the previous one and the statements prepared on it:
+// collectors still running on it fail and get the new one on their next run.
+func (t *target) setConn(conn *sql.DB) {
+	t.content_mutex.Lock()
+	defer t.content_mutex.Unlock()
+	if t.conn != nil && t.conn != conn {
+		t.conn.Close()
+		closeStatements(t.collectors, t.conn)
+	}
+	t.conn = conn
+}
+
 // boolToFloat64 converts a boolean flag to a float64 value (0.0 or 1.0).
 func boolToFloat64(value bool) float64 {
 	if value {
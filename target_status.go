@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errorState keeps the status of the last run of a target connection, collector or query, with its last error and the
+// number of consecutive failed runs. A successful run resets the count but keeps the last error and its time for
+// diagnosis. Runs of concurrent scrapes update it under its lock.
+type errorState struct {
+	mutex    sync.Mutex
+	ran      bool
+	status   int
+	err      error
+	time     time.Time
+	failures int
+}
+
+// record updates the state with the status of a run and the error that set it (unused if the run is ok).
+func (s *errorState) record(status int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ran = true
+	s.status = status
+	if status == CollectorStatusOk {
+		s.failures = 0
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("status %s", statusText(status))
+	}
+	s.err = err
+	// no monotonic clock reading: the time is displayed
+	s.time = time.Now().Round(0)
+	s.failures++
+}
+
+// Status returns the status of the last run (CollectorStatusError if none).
+func (s *errorState) Status() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+// SetStatus sets the status without a run (e.g. collectors of a target that is down).
+func (s *errorState) SetStatus(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ran = true
+	s.status = status
+}
+
+// ErrorStatus is the status and last error of a target connection, collector or query as exposed by
+// `/targets/<name>/status`.
+type ErrorStatus struct {
+	Status              int        `json:"status"`
+	StatusText          string     `json:"status_text"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorTime       *time.Time `json:"last_error_time,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// errorStatus returns a copy of the state.
+func (s *errorState) errorStatus() ErrorStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := ErrorStatus{
+		Status:              s.status,
+		StatusText:          "not run",
+		ConsecutiveFailures: s.failures,
+	}
+	if s.ran {
+		status.StatusText = statusText(s.status)
+	}
+	if s.err != nil {
+		errTime := s.time
+		status.LastError = errorMessage(s.err)
+		status.LastErrorTime = &errTime
+	}
+	return status
+}
+
+// QueryStatus is the status of a query of a collector of a target.
+type QueryStatus struct {
+	Name string `json:"name"`
+	ErrorStatus
+}
+
+// CollectorStatus is the status of a collector of a target and of its queries.
+type CollectorStatus struct {
+	Name string `json:"name"`
+	ErrorStatus
+	Queries []*QueryStatus `json:"queries"`
+}
+
+// TargetStatus is the status of a target connection and of its collectors.
+type TargetStatus struct {
+	Name string `json:"name"`
+	ErrorStatus
+	Collectors []*CollectorStatus `json:"collectors"`
+}
+
+// statusText returns the name of a collector status (see collector_status metric).
+func statusText(status int) string {
+	switch status {
+	case CollectorStatusOk:
+		return "ok"
+	case CollectorStatusInvalidLogin:
+		return "invalid login"
+	case CollectorStatusTimeout:
+		return "timeout"
+	case CollectorStatusPartial:
+		return "partial"
+	}
+	return "error"
+}
+
+// errorStatusReporter is implemented by collectors keeping the last error of their runs and of their queries.
+type errorStatusReporter interface {
+	// CollectorStatus returns the status and last errors of the collector and of its queries.
+	CollectorStatus() *CollectorStatus
+}
+
+// CollectorStatus implements errorStatusReporter.
+func (c *collector) CollectorStatus() *CollectorStatus {
+	status := &CollectorStatus{
+		Name:        c.config.Name,
+		ErrorStatus: c.lastError.errorStatus(),
+		Queries:     make([]*QueryStatus, len(c.queries)),
+	}
+	for i, q := range c.queries {
+		status.Queries[i] = &QueryStatus{
+			Name:        q.config.Name,
+			ErrorStatus: q.lastError.errorStatus(),
+		}
+	}
+	return status
+}
+
+// CollectorStatus implements errorStatusReporter.
+func (cc *cachingCollector) CollectorStatus() *CollectorStatus {
+	return cc.rawColl.CollectorStatus()
+}
+
+// TargetStatus implements Target.TargetStatus.
+func (t *target) TargetStatus() *TargetStatus {
+	status := &TargetStatus{
+		Name:        t.config.Name,
+		ErrorStatus: t.lastError.errorStatus(),
+		Collectors:  make([]*CollectorStatus, 0, len(t.collectors)),
+	}
+	for _, c := range t.collectors {
+		if r, ok := c.(errorStatusReporter); ok {
+			status.Collectors = append(status.Collectors, r.CollectorStatus())
+		}
+	}
+	return status
+}
+
+// collectErrors forwards the metrics sent by a collector run to ch, and returns the errors it reported once the
+// returned channel is closed.
+func collectErrors(ch chan<- Metric) (chan<- Metric, <-chan error) {
+	in := make(chan Metric, capMetricChan)
+	done := make(chan error, 1)
+	go func() {
+		var errs []error
+		for metric := range in {
+			if m, ok := metric.(invalidMetric); ok {
+				errs = append(errs, invalidMetricError(m))
+			}
+			ch <- metric
+		}
+		done <- errors.Join(errs...)
+	}()
+	return in, done
+}
+
+// invalidMetricError returns the error of the invalid metric, with the name of the query that reported it if any.
+func invalidMetricError(m invalidMetric) error {
+	for i := 0; i+1 < len(m.logContext); i += 2 {
+		if m.logContext[i] == "query" {
+			return fmt.Errorf("query %v: %s", m.logContext[i+1], errorMessage(m.err))
+		}
+	}
+	return errors.New(errorMessage(m.err))
+}
+
+// errorMessage returns the message of the error without the log context added by ErrorWrap(): the status already tells
+// the target, collector and query of the error.
+func errorMessage(err error) string {
+	for {
+		w, ok := err.(*wrappedError)
+		if !ok {
+			return err.Error()
+		}
+		err = w.err
+	}
+}
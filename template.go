@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// queryTemplateFuncs returns the functions available in query templates; quote functions follow the SQL dialect of
+// the driver (database/sql driver name), standard SQL if empty.
+//
+//   - quote: SQL string literal, with single quotes doubled
+//   - quoteIdent: quoted identifier ("name", [name] for mssql, `name` for mysql)
+//   - quoteList: comma separated list of string literals, for IN (...) clause
+//   - join: join list elements with separator
+//   - list: build a list from its arguments
+//   - default: value if not empty, else default value
+//   - env: environment variable value
+//   - now, ago, timeAdd, formatTime, unix: date arithmetic (durations in Go format: "90s", "-1h", "24h")
+func queryTemplateFuncs(driver string) template.FuncMap {
+	quote := func(value any) string {
+		s := fmt.Sprint(value)
+		if driver == "mysql" {
+			s = strings.ReplaceAll(s, `\`, `\\`)
+		}
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return template.FuncMap{
+		"quote": quote,
+		"quoteIdent": func(value any) string {
+			s := fmt.Sprint(value)
+			switch driver {
+			case "sqlserver":
+				return "[" + strings.ReplaceAll(s, "]", "]]") + "]"
+			case "mysql":
+				return "`" + strings.ReplaceAll(s, "`", "``") + "`"
+			}
+			return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+		},
+		"quoteList": func(list any) string {
+			elems := templateList(list)
+			for i, elem := range elems {
+				elems[i] = quote(elem)
+			}
+			return strings.Join(elems, ", ")
+		},
+		"join": func(sep string, list any) string {
+			return strings.Join(templateList(list), sep)
+		},
+		"list": func(elems ...any) []any {
+			return elems
+		},
+		"default": func(def any, value any) any {
+			if value == nil {
+				return def
+			}
+			if v := reflect.ValueOf(value); v.IsZero() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+				return def
+			}
+			return value
+		},
+		"env": os.Getenv,
+		"now": time.Now,
+		"ago": func(duration string) (time.Time, error) {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Now().Add(-d), nil
+		},
+		"timeAdd": func(duration string, t time.Time) (time.Time, error) {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return t.Add(d), nil
+		},
+		"formatTime": func(layout string, t time.Time) string {
+			return t.Format(layout)
+		},
+		"unix": func(t time.Time) int64 {
+			return t.Unix()
+		},
+	}
+}
+
+// templateList converts a list (slice of any type, or single value) to a list of strings.
+func templateList(list any) []string {
+	if list == nil {
+		return nil
+	}
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []string{fmt.Sprint(list)}
+	}
+	res := make([]string, v.Len())
+	for i := range res {
+		res[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return res
+}
+
+// parseQueryTemplate parses the query if it contains a template ("{{"), nil otherwise.
+func parseQueryTemplate(name string, query string) (*template.Template, error) {
+	if !strings.Contains(query, "{{") {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Funcs(queryTemplateFuncs("")).Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for query %q: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+// renderQueryTemplate renders the parsed query template with the target symbols table, with quote functions of the
+// driver dialect.
+func renderQueryTemplate(tmpl *template.Template, driver string, symbols_table map[string]any) (string, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	b := new(strings.Builder)
+	if err := tmpl.Funcs(queryTemplateFuncs(driver)).Execute(b, symbols_table); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// parseLabelTemplate parses a static label value if it contains a template ("{{"), nil otherwise; missing variables
+// are rendered as empty strings.
+func parseLabelTemplate(name string, value string) (*template.Template, error) {
+	if !strings.Contains(value, "{{") {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Funcs(queryTemplateFuncs("")).Option("missingkey=zero").Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for label %q: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+// renderLabelTemplate renders a static label value with the variables of the target.
+func renderLabelTemplate(name string, value string, variables VariablesConfig) (string, error) {
+	tmpl, err := parseLabelTemplate(name, value)
+	if err != nil || tmpl == nil {
+		return value, err
+	}
+	b := new(strings.Builder)
+	if err := tmpl.Execute(b, variables); err != nil {
+		return "", fmt.Errorf("invalid template for label %q: %s", name, err)
+	}
+	return b.String(), nil
+}